@@ -13,20 +13,36 @@ type Config struct {
 	Crypt        string `json:"crypt"`
 	Mode         string `json:"mode"`
 	Conn         int    `json:"conn"`
+	SharedSocket bool   `json:"sharedsocket"`
+	Multipath    string `json:"multipath"`
+	PathMode     string `json:"multipathmode"`
 	AutoExpire   int    `json:"autoexpire"`
 	ScavengeTTL  int    `json:"scavengettl"`
 	MTU          int    `json:"mtu"`
+	MTULimit     int    `json:"mtulimit"`
+	PMTUD        bool   `json:"pmtud"`
 	SndWnd       int    `json:"sndwnd"`
 	RcvWnd       int    `json:"rcvwnd"`
+	DataShard    int    `json:"datashard"`
+	ParityShard  int    `json:"parityshard"`
+	FECAdaptive  bool   `json:"fecadaptive"`
 	DSCP         int    `json:"dscp"`
 	AckNodelay   bool   `json:"acknodelay"`
 	NoDelay      int    `json:"nodelay"`
 	Interval     int    `json:"interval"`
 	Resend       int    `json:"resend"`
 	NoCongestion int    `json:"nc"`
+	Congestion   string `json:"congestion"`
+	DeadLink     int    `json:"deadlink"`
+	RateLimit    int    `json:"ratelimit"`
+	Pacing       bool   `json:"pacing"`
 	SockBuf      int    `json:"sockbuf"`
 	KeepAlive    int    `json:"keepalive"`
+	IdleTimeout  int    `json:"idletimeout"`
 	Log          string `json:"log"`
+	SnmpLog      string `json:"snmplog"`
+	SnmpPeriod   int    `json:"snmpperiod"`
+	StatsPeriod  int    `json:"statsperiod"`
 	Quiet        bool   `json:"quiet"`
 	TCP          bool   `json:"tcp"`
 }
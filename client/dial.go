@@ -1,18 +1,124 @@
 package main
 
 import (
+	"net"
+	"strings"
+
 	"github.com/JimLee1996/tun/kcp"
 	"github.com/JimLee1996/tun/tcpraw"
 	"github.com/pkg/errors"
 )
 
-func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
+// sharedSocket is a dialer sharing one socket among the sessions, with the
+// address of the server it reaches
+type sharedSocket struct {
+	*kcp.Dialer
+	raddr string
+}
+
+// dial establishes a session with the server, over the socket of 'shared' if
+// it isn't nil, over paths of its own with multipath, or over a socket of
+// its own
+func dial(config *Config, block kcp.BlockCrypt, shared *sharedSocket) (*kcp.UDPSession, error) {
+	if config.Multipath != "" {
+		return dialMultipath(config, block)
+	}
+	if shared != nil {
+		sess, err := shared.Dial(shared.raddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "kcp.Dialer.Dial()")
+		}
+		return sess, nil
+	}
+	if config.TCP {
+		conn, err := tcpraw.Dial("tcp", config.RemoteAddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "tcpraw.Dial()")
+		}
+		// the session goes to the address the TCP connection was established with
+		sess, err := kcp.NewConn(conn.RemoteAddr().String(), block, config.DataShard, config.ParityShard, conn)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "kcp.NewConn()")
+		}
+		return sess, nil
+	}
+	return kcp.DialWithOptions(config.RemoteAddr, block, config.DataShard, config.ParityShard)
+}
+
+// newSharedSocket creates a dialer sharing one socket among the sessions, a
+// dual-stack UDP socket reaches the server on either address family
+func newSharedSocket(config *Config, block kcp.BlockCrypt) (*sharedSocket, error) {
 	if config.TCP {
 		conn, err := tcpraw.Dial("tcp", config.RemoteAddr)
 		if err != nil {
 			return nil, errors.Wrap(err, "tcpraw.Dial()")
 		}
-		return kcp.NewConn(config.RemoteAddr, block, conn)
+		dialer := kcp.NewDialer(block, config.DataShard, config.ParityShard, conn)
+		return &sharedSocket{dialer, conn.RemoteAddr().String()}, nil
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUDP()")
+	}
+	dialer := kcp.NewDialer(block, config.DataShard, config.ParityShard, conn)
+	return &sharedSocket{dialer, config.RemoteAddr}, nil
+}
+
+// dialMultipath establishes a session with the server spreading its packets
+// over a path per entry of config.Multipath, a UDP socket bound to a local IP
+// or "tcp" for an emulated TCP connection
+func dialMultipath(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
+	raddr, err := net.ResolveUDPAddr("udp", config.RemoteAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ResolveUDPAddr()")
+	}
+
+	locals := strings.Split(config.Multipath, ",")
+	tcp := 0
+	for i := range locals {
+		locals[i] = strings.TrimSpace(locals[i])
+		if locals[i] == "tcp" {
+			tcp++
+		}
+	}
+	if tcp > 0 && tcp < len(locals) { // the server listens on UDP and TCP separately
+		return nil, errors.Errorf("multipath %q mixes 'tcp' and UDP paths", config.Multipath)
+	}
+
+	mconn := kcp.NewMultipathConn(block, config.DataShard, config.ParityShard)
+	if config.PathMode == "redundant" {
+		mconn.SetMode(kcp.MultipathRedundant)
+	}
+	for _, local := range locals {
+		if local == "tcp" {
+			conn, err := tcpraw.Dial("tcp", config.RemoteAddr)
+			if err != nil {
+				mconn.Close()
+				return nil, errors.Wrap(err, "tcpraw.Dial()")
+			}
+			mconn.AddPath(conn, conn.RemoteAddr())
+			continue
+		}
+
+		ip := net.ParseIP(local)
+		if ip == nil {
+			mconn.Close()
+			return nil, errors.Errorf("invalid multipath address %q", local)
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			mconn.Close()
+			return nil, errors.Wrap(err, "net.ListenUDP()")
+		}
+		mconn.AddPath(conn, raddr)
+	}
+
+	sess, err := kcp.NewConn(raddr.String(), block, config.DataShard, config.ParityShard, mconn)
+	if err != nil {
+		mconn.Close()
+		return nil, errors.Wrap(err, "kcp.NewConn()")
 	}
-	return kcp.DialWithOptions(config.RemoteAddr, block)
+	return sess, nil
 }
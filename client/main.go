@@ -11,6 +11,7 @@ import (
 
 	"github.com/JimLee1996/tun/kcp"
 	"github.com/JimLee1996/tun/smux"
+	"github.com/JimLee1996/tun/std"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/pbkdf2"
@@ -23,6 +24,10 @@ var (
 	SALT = "swag"
 )
 
+// the data queued in a closed session is still sent for this long,
+// so that the last bytes of an expired session are not lost
+const lingerTimeout = 10 * time.Second
+
 func handleClient(sess *smux.Session, p1 io.ReadWriteCloser, quiet bool) {
 	if !quiet {
 		log.Println("stream opened")
@@ -100,6 +105,20 @@ func main() {
 			Value: 1,
 			Usage: "set num of UDP connections to server",
 		},
+		cli.BoolFlag{
+			Name:  "sharedsocket",
+			Usage: "to share one socket among the UDP connections to server",
+		},
+		cli.StringFlag{
+			Name:  "multipath",
+			Value: "",
+			Usage: "comma-separated local IPs, each connection to server spreads its packets over a path bound to each of them, or all 'tcp' for emulated TCP paths(linux)",
+		},
+		cli.StringFlag{
+			Name:  "multipathmode",
+			Value: "weighted",
+			Usage: "scheduling over the paths: weighted, redundant",
+		},
 		cli.IntFlag{
 			Name:  "autoexpire",
 			Value: 0,
@@ -115,6 +134,15 @@ func main() {
 			Value: 1350,
 			Usage: "set maximum transmission unit for UDP packets",
 		},
+		cli.IntFlag{
+			Name:  "mtulimit",
+			Value: 1500,
+			Usage: "the largest UDP packet ever sent or received, above 1500 for jumbo frames",
+		},
+		cli.BoolFlag{
+			Name:  "pmtud",
+			Usage: "discover the path mtu with DF-marked probes, up to mtulimit",
+		},
 		cli.IntFlag{
 			Name:  "sndwnd",
 			Value: 128,
@@ -125,6 +153,20 @@ func main() {
 			Value: 512,
 			Usage: "set receive window size(num of packets)",
 		},
+		cli.IntFlag{
+			Name:  "datashard,ds",
+			Value: 0,
+			Usage: "set reed-solomon erasure coding - datashard, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "parityshard,ps",
+			Value: 0,
+			Usage: "set reed-solomon erasure coding - parityshard, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "fecadaptive",
+			Usage: "adapt the parityshards sent to the measured loss rate, parityshard as the upper bound",
+		},
 		cli.IntFlag{
 			Name:  "dscp",
 			Value: 0,
@@ -155,6 +197,25 @@ func main() {
 			Value:  0,
 			Hidden: true,
 		},
+		cli.StringFlag{
+			Name:  "congestion",
+			Value: "",
+			Usage: "congestion control: reno, bbr, it overrides nc of the mode profiles",
+		},
+		cli.IntFlag{
+			Name:  "deadlink",
+			Value: 20,
+			Usage: "close the connection after a segment has been sent this many times, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "ratelimit",
+			Value: 0,
+			Usage: "per-connection send rate limit in bytes per second, 0 for unlimited",
+		},
+		cli.BoolFlag{
+			Name:  "pacing",
+			Usage: "spread packets over the flush interval instead of sending them in bursts",
+		},
 		cli.IntFlag{
 			Name:  "sockbuf",
 			Value: 4194304, // socket buffer size in bytes
@@ -163,7 +224,27 @@ func main() {
 		cli.IntFlag{
 			Name:  "keepalive",
 			Value: 10, // nat keepalive interval in seconds
-			Usage: "seconds between heartbeats",
+			Usage: "seconds between heartbeats, of both smux and kcp",
+		},
+		cli.IntFlag{
+			Name:  "idletimeout",
+			Value: 0,
+			Usage: "close a connection after receiving nothing for this many seconds, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "snmplog",
+			Value: "",
+			Usage: "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+		},
+		cli.IntFlag{
+			Name:  "snmpperiod",
+			Value: 60,
+			Usage: "snmp collect period, in seconds",
+		},
+		cli.IntFlag{
+			Name:  "statsperiod",
+			Value: 0,
+			Usage: "seconds between logging the transport stats of each session, 0 to disable",
 		},
 		cli.StringFlag{
 			Name:  "log",
@@ -192,19 +273,35 @@ func main() {
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.Conn = c.Int("conn")
+		config.SharedSocket = c.Bool("sharedsocket")
+		config.Multipath = c.String("multipath")
+		config.PathMode = c.String("multipathmode")
 		config.AutoExpire = c.Int("autoexpire")
 		config.ScavengeTTL = c.Int("scavengettl")
 		config.MTU = c.Int("mtu")
+		config.MTULimit = c.Int("mtulimit")
+		config.PMTUD = c.Bool("pmtud")
 		config.SndWnd = c.Int("sndwnd")
 		config.RcvWnd = c.Int("rcvwnd")
+		config.DataShard = c.Int("datashard")
+		config.ParityShard = c.Int("parityshard")
+		config.FECAdaptive = c.Bool("fecadaptive")
 		config.DSCP = c.Int("dscp")
 		config.AckNodelay = c.Bool("acknodelay")
 		config.NoDelay = c.Int("nodelay")
 		config.Interval = c.Int("interval")
 		config.Resend = c.Int("resend")
 		config.NoCongestion = c.Int("nc")
+		config.Congestion = c.String("congestion")
+		config.DeadLink = c.Int("deadlink")
+		config.RateLimit = c.Int("ratelimit")
+		config.Pacing = c.Bool("pacing")
 		config.SockBuf = c.Int("sockbuf")
 		config.KeepAlive = c.Int("keepalive")
+		config.IdleTimeout = c.Int("idletimeout")
+		config.SnmpLog = c.String("snmplog")
+		config.SnmpPeriod = c.Int("snmpperiod")
+		config.StatsPeriod = c.Int("statsperiod")
 		config.Log = c.String("log")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
@@ -232,6 +329,9 @@ func main() {
 		case "fast3":
 			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
 		}
+		if config.Congestion != "" {
+			config.NoCongestion = 0
+		}
 
 		log.Println("version:", VERSION)
 		log.Println("tcpraw:", config.TCP)
@@ -241,6 +341,8 @@ func main() {
 		listener, err := net.ListenTCP("tcp", addr)
 		checkError(err)
 
+		checkError(kcp.SetMTULimit(config.MTULimit))
+
 		log.Println("initiating key derivation")
 		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
 		log.Println("key derivation done")
@@ -255,24 +357,54 @@ func main() {
 		log.Println("listening on:", listener.Addr())
 		log.Println("encryption:", config.Crypt)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+		log.Println("congestion:", config.Congestion)
 		log.Println("remote address:", config.RemoteAddr)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("mtu:", config.MTU)
+		log.Println("mtu:", config.MTU, "mtulimit:", config.MTULimit)
+		log.Println("pmtud:", config.PMTUD)
+		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+		log.Println("fecadaptive:", config.FECAdaptive)
 		log.Println("acknodelay:", config.AckNodelay)
 		log.Println("dscp:", config.DSCP)
+		log.Println("deadlink:", config.DeadLink)
+		log.Println("ratelimit:", config.RateLimit)
+		log.Println("pacing:", config.Pacing)
 		log.Println("sockbuf:", config.SockBuf)
 		log.Println("keepalive:", config.KeepAlive)
+		log.Println("idletimeout:", config.IdleTimeout)
 		log.Println("conn:", config.Conn)
+		log.Println("sharedsocket:", config.SharedSocket)
+		log.Println("multipath:", config.Multipath)
+		log.Println("multipathmode:", config.PathMode)
 		log.Println("autoexpire:", config.AutoExpire)
 		log.Println("scavengettl:", config.ScavengeTTL)
+		log.Println("snmplog:", config.SnmpLog)
+		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("statsperiod:", config.StatsPeriod)
 		log.Println("quiet:", config.Quiet)
 
 		smuxConfig := smux.DefaultConfig()
 		smuxConfig.MaxReceiveBuffer = config.SockBuf
 		smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
 
+		// the connections to server share one socket, unless each has paths of its own
+		var shared *sharedSocket
+		if config.SharedSocket && config.Multipath == "" {
+			shared, err = newSharedSocket(&config, block)
+			checkError(err)
+			if err := shared.SetDSCP(config.DSCP); err != nil {
+				log.Println("SetDSCP:", err)
+			}
+			if err := shared.SetReadBuffer(config.SockBuf); err != nil {
+				log.Println("SetReadBuffer:", err)
+			}
+			if err := shared.SetWriteBuffer(config.SockBuf); err != nil {
+				log.Println("SetWriteBuffer:", err)
+			}
+		}
+
 		createConn := func() (*smux.Session, error) {
-			kcpconn, err := dial(&config, block)
+			kcpconn, err := dial(&config, block, shared)
 			if err != nil {
 				return nil, errors.Wrap(err, "createConn()")
 			}
@@ -281,16 +413,36 @@ func main() {
 			kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 			kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
 			kcpconn.SetMtu(config.MTU)
-			kcpconn.SetACKNoDelay(config.AckNodelay)
-
-			if err := kcpconn.SetDSCP(config.DSCP); err != nil {
-				log.Println("SetDSCP:", err)
+			if config.PMTUD {
+				if err := kcpconn.SetPMTUDiscovery(true); err != nil {
+					log.Println("SetPMTUDiscovery:", err)
+				}
 			}
-			if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
-				log.Println("SetReadBuffer:", err)
+			kcpconn.SetACKNoDelay(config.AckNodelay)
+			kcpconn.SetFECAdaptive(config.FECAdaptive)
+			kcpconn.SetDeadLink(config.DeadLink)
+			kcpconn.SetLinger(lingerTimeout)
+			kcpconn.SetPacing(config.Pacing)
+			kcpconn.SetRateLimit(config.RateLimit)
+			kcpconn.SetKeepAlive(time.Duration(config.KeepAlive) * time.Second)
+			kcpconn.SetIdleTimeout(time.Duration(config.IdleTimeout) * time.Second)
+			switch config.Congestion {
+			case "reno":
+				kcpconn.SetCongestionController(kcp.NewRenoController())
+			case "bbr":
+				kcpconn.SetCongestionController(kcp.NewBBRController())
 			}
-			if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
-				log.Println("SetWriteBuffer:", err)
+
+			if shared == nil {
+				if err := kcpconn.SetDSCP(config.DSCP); err != nil {
+					log.Println("SetDSCP:", err)
+				}
+				if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
+					log.Println("SetReadBuffer:", err)
+				}
+				if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
+					log.Println("SetWriteBuffer:", err)
+				}
 			}
 
 			// stream multiplex
@@ -301,6 +453,7 @@ func main() {
 				return nil, errors.Wrap(err, "createConn()")
 			}
 			log.Println("connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
+			go std.StatsLogger(kcpconn, session, config.StatsPeriod)
 			return session, nil
 		}
 
@@ -327,6 +480,8 @@ func main() {
 			muxes[k].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
 		}
 
+		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+
 		chScavenger := make(chan *smux.Session, 128)
 		go scavenger(chScavenger, config.ScavengeTTL)
 		rr := uint16(0)
@@ -0,0 +1,83 @@
+// +build linux
+
+package kcp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// plainConn hides the *net.UDPConn of a socket, the sessions and the
+// listener fall back to the unbatched I/O on it
+type plainConn struct {
+	net.PacketConn
+}
+
+// benchmarkLoopback streams to a listener over loopback and reports the
+// packets per second written by both ends
+func benchmarkLoopback(b *testing.B, batch bool) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.SetReadBuffer(4 << 20)
+		conn.SetWriteBuffer(4 << 20)
+		if batch {
+			return conn
+		}
+		return plainConn{conn}
+	}
+
+	buf := make([]byte, 64<<10)
+	total := int64(b.N) * int64(len(buf))
+	done := make(chan error, 1)
+	sconn := listen()
+	l, _ := ServeConn(nil, 0, 0, sconn)
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetWindowSize(2048, 2048)
+		_, err = io.CopyN(ioutil.Discard, s, total)
+		done <- err
+	}()
+
+	c, err := NewConn(sconn.LocalAddr().String(), nil, 0, 0, listen())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	c.SetNoDelay(1, 10, 2, 1)
+	c.SetWindowSize(2048, 2048)
+	c.SetWriteDelay(true)
+
+	DefaultSnmp.Reset()
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	start := time.Now()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadUint64(&DefaultSnmp.OutPkts))/time.Since(start).Seconds(), "pkts/s")
+}
+
+func BenchmarkLoopbackBatch(b *testing.B)   { benchmarkLoopback(b, true) }
+func BenchmarkLoopbackNoBatch(b *testing.B) { benchmarkLoopback(b, false) }
@@ -0,0 +1,192 @@
+package kcp
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the KCP timers, and of the updater scheduling
+// the sessions. A session takes the clock of its packet connection if the
+// connection has a `Clock() Clock` method, or SystemClock otherwise.
+//
+// Clock is an alias of an interface literal, so that a packet connection can
+// provide a clock without importing this package, like package netem does.
+// A clock with an `AfterFunc(d time.Duration, f func()) (stop func() bool)`
+// method also runs the deadlines, the pacing and the handshake timers of the
+// sessions, the timers of any other clock are real ones.
+//
+// The sessions on a ManualClock are updated by its Advance method, those on
+// any other clock by the global updater on real timers.
+type Clock = interface {
+	Now() time.Time
+}
+
+// timerClock is a Clock providing its own timers
+type timerClock interface {
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool { return time.AfterFunc(d, f).Stop }
+
+// SystemClock reads the real time
+var SystemClock Clock = systemClock{}
+
+// monotonic reference time point
+var refTime = time.Now()
+
+// currentMs returns elapsed milliseconds of a clock since program startup
+func currentMs(clock Clock) uint32 { return uint32(clock.Now().Sub(refTime) / time.Millisecond) }
+
+// afterFunc calls 'f' once 'd' has elapsed on a clock, it returns a function
+// to stop the timer like time.Timer.Stop
+func afterFunc(clock Clock, d time.Duration, f func()) (stop func() bool) {
+	if tc, ok := clock.(timerClock); ok {
+		return tc.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f).Stop
+}
+
+// after returns a channel closed once 'd' has elapsed on a clock, and a
+// function to stop the timer
+func after(clock Clock, d time.Duration) (<-chan struct{}, func() bool) {
+	ch := make(chan struct{})
+	return ch, afterFunc(clock, d, func() { close(ch) })
+}
+
+// ManualClock is a Clock stepped by hand, for tests to drive the timers of
+// retransmission, window probing and dead link deterministically, along with
+// the deadlines, the pacing and the handshake of the sessions. Its timers let
+// a packet connection, like the one of package netem, follow it too.
+type ManualClock struct {
+	mu        sync.Mutex
+	now       time.Time
+	timers    manualTimers
+	seq       uint64     // order of the timers registered
+	advanceMu sync.Mutex // serializes Advance
+	updater   *updater   // the sessions on this clock, a single shard run by Advance
+}
+
+// a timer of a ManualClock
+type manualTimer struct {
+	at  time.Time
+	seq uint64 // breaks ties of 'at' in the order of registration
+	f   func()
+	idx int // index in the heap, -1 once fired or stopped
+}
+
+// manualTimers orders the timers of a ManualClock by expiry
+type manualTimers []*manualTimer
+
+func (h manualTimers) Len() int { return len(h) }
+func (h manualTimers) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h manualTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+func (h *manualTimers) Push(x interface{}) {
+	t := x.(*manualTimer)
+	t.idx = len(*h)
+	*h = append(*h, t)
+}
+func (h *manualTimers) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.idx = -1
+	*h = old[:n-1]
+	return t
+}
+
+// NewManualClock creates a ManualClock reading 'start'
+func NewManualClock(start time.Time) *ManualClock {
+	c := new(ManualClock)
+	c.now = start
+	c.updater = newUpdater(c, 1)
+	return c
+}
+
+// Now returns the time of the clock
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc calls 'f' once the clock has been advanced by 'd', in the
+// goroutine calling Advance, so 'f' must not block. It returns a function
+// to stop the timer like time.Timer.Stop.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	c.mu.Lock()
+	t := &manualTimer{at: c.now.Add(d), seq: c.seq, f: f}
+	c.seq++
+	heap.Push(&c.timers, t)
+	c.mu.Unlock()
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if t.idx < 0 {
+			return false
+		}
+		heap.Remove(&c.timers, t.idx)
+		return true
+	}
+}
+
+// fireTimers calls the timers expired by now
+func (c *ManualClock) fireTimers() {
+	for {
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].at.After(c.now) {
+			c.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&c.timers).(*manualTimer)
+		c.mu.Unlock()
+		t.f()
+	}
+}
+
+// Advance moves the clock forward by 'd', stopping at the time every session
+// on the clock is due to update it and every timer expires, in the order of
+// their schedule. The updates and the timers run in the calling goroutine.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.advanceMu.Lock()
+	defer c.advanceMu.Unlock()
+
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.fireTimers()
+		next := c.updater.shards[0].runDue()
+		c.mu.Lock()
+		if len(c.timers) > 0 && (next.IsZero() || c.timers[0].at.Before(next)) {
+			next = c.timers[0].at
+		}
+		if next.IsZero() || next.After(target) {
+			c.mu.Unlock()
+			break
+		}
+		if next.After(c.now) {
+			c.now = next
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.now = target
+	c.mu.Unlock()
+}
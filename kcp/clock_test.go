@@ -0,0 +1,131 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// silentConn is a socket on a clock, which counts and discards the packets
+// written and never receives any
+type silentConn struct {
+	net.PacketConn
+	clock  Clock
+	writes int32
+}
+
+func (c *silentConn) Clock() Clock { return c.clock }
+func (c *silentConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return len(b), nil
+}
+
+// the handshake and the deadlines of the sessions and the listeners expire
+// on the clock of their connection, rather than on real time
+func TestManualClockTimers(t *testing.T) {
+	const step = 10 * time.Millisecond
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	tests := []struct {
+		name  string
+		after time.Duration // the time the operation fails after
+		run   func(clock Clock, conn net.PacketConn) error
+	}{
+		{"handshake", handshakeTimeout, func(clock Clock, conn net.PacketConn) error {
+			_, err := NewConn(remote.String(), nil, 0, 0, conn)
+			return err
+		}},
+		{"multipath handshake", handshakeTimeout, func(clock Clock, conn net.PacketConn) error {
+			mc := NewMultipathConn(nil, 0, 0)
+			if err := mc.AddPath(conn, remote); err != nil {
+				return err
+			}
+			_, err := NewConn(remote.String(), nil, 0, 0, mc)
+			mc.Close()
+			return err
+		}},
+		{"read", time.Second, func(clock Clock, conn net.PacketConn) error {
+			s := newUDPSession(1, 0, 0, nil, nil, conn, remote, nil)
+			defer s.Close()
+			s.SetReadDeadline(clock.Now().Add(time.Second))
+			_, err := s.Read(make([]byte, 1))
+			return err
+		}},
+		{"write", time.Second, func(clock Clock, conn net.PacketConn) error {
+			s := newUDPSession(1, 0, 0, nil, nil, conn, remote, nil)
+			defer s.Close()
+			s.SetWindowSize(1, 1)
+			s.SetWriteDeadline(clock.Now().Add(time.Second))
+			for {
+				if _, err := s.Write(make([]byte, 1024)); err != nil {
+					return err
+				}
+			}
+		}},
+		{"accept", time.Second, func(clock Clock, conn net.PacketConn) error {
+			l, _ := ServeConn(nil, 0, 0, conn)
+			defer l.Close()
+			l.SetReadDeadline(clock.Now().Add(time.Second))
+			_, err := l.AcceptKCP()
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			start := time.Unix(1e9, 0)
+			clock := NewManualClock(start)
+			conn := &silentConn{PacketConn: raw, clock: clock}
+			done := make(chan error, 1)
+			go func() { done <- tt.run(clock, conn) }()
+
+			select {
+			case err := <-done:
+				t.Fatal("expired on real time:", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			for {
+				select {
+				case err := <-done:
+					elapsed := clock.Now().Sub(start)
+					if elapsed < tt.after || elapsed > tt.after+handshakeRTO {
+						t.Fatalf("expired after %v, want %v", elapsed, tt.after)
+					}
+					if ne, ok := err.(net.Error); err != ErrHandshakeTimeout && !(ok && ne.Timeout()) {
+						t.Fatal(err)
+					}
+					return
+				case <-time.After(time.Millisecond):
+				}
+				clock.Advance(step)
+			}
+		})
+	}
+}
+
+// the cookies of a listener age on the clock of its connection
+func TestManualClockCookie(t *testing.T) {
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewManualClock(time.Unix(1e9, 0))
+	l, _ := ServeConn(nil, 0, 0, &silentConn{PacketConn: raw, clock: clock})
+	defer l.Close()
+
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	cookie := l.newCookie(1, remote)
+	clock.Advance(cookieLifetime)
+	if !l.verifyCookie(1, remote, cookie) {
+		t.Fatal("cookie expired early")
+	}
+	clock.Advance(time.Second)
+	if l.verifyCookie(1, remote, cookie) {
+		t.Fatal("cookie not expired")
+	}
+}
@@ -0,0 +1,319 @@
+package kcp
+
+// CongestionInfo is a snapshot of the KCP states a CongestionController works on
+type CongestionInfo struct {
+	Current    uint32 // current timestamp in millisec
+	Mss        uint32 // maximum segment size in bytes
+	Inflight   uint32 // segments sent but not acknowledged yet, and datagrams sent within an RTT
+	SndWnd     uint32 // local send window in segments
+	RmtWnd     uint32 // remote receive window in segments
+	FastResend uint32 // fast retransmit trigger, 0 if disabled
+	Srtt       int32  // smoothed round trip time in millisec
+	Interval   uint32 // flush interval in millisec
+}
+
+// CongestionController decides the congestion window of a KCP connection.
+// It's not called when congestion control has been turned off by NoDelay().
+type CongestionController interface {
+	// OnAck is called in Input when 'acked' segments have been acknowledged
+	// cumulatively, rtt is the latest RTT sample in millisec, or -1 if the
+	// packet carried no sample.
+	OnAck(info *CongestionInfo, acked uint32, rtt int32)
+
+	// OnLoss is called at the end of flush when segments have been retransmitted,
+	// 'lost' by RTO, 'fast' by fast or early retransmit.
+	OnLoss(info *CongestionInfo, lost, fast uint32)
+
+	// OnFlush is called in flush before new segments are moved into the send
+	// buffer, and returns the congestion window in segments.
+	OnFlush(info *CongestionInfo) uint32
+}
+
+// PacingRater is implemented by a CongestionController which estimates the
+// rate packets should be paced at
+type PacingRater interface {
+	// PacingRate returns the rate in bytes per second, or 0 if unknown yet
+	PacingRate() uint64
+}
+
+// renoController is the classic KCP congestion control, slow start and
+// congestion avoidance on ack, rate halving on fast retransmit,
+// and reset to 1 segment on RTO.
+type renoController struct {
+	cwnd, ssthresh, incr uint32
+	window               uint32 // the effective window of the last flush
+}
+
+// NewRenoController creates the TCP-like congestion controller KCP uses by default
+func NewRenoController() CongestionController {
+	r := new(renoController)
+	r.cwnd = 1
+	r.ssthresh = IKCP_THRESH_INIT
+	return r
+}
+
+func (r *renoController) OnAck(info *CongestionInfo, acked uint32, rtt int32) {
+	if r.cwnd < info.RmtWnd {
+		mss := info.Mss
+		if r.cwnd < r.ssthresh {
+			r.cwnd++
+			r.incr += mss
+		} else {
+			if r.incr < mss {
+				r.incr = mss
+			}
+			r.incr += (mss*mss)/r.incr + (mss / 16)
+			if (r.cwnd+1)*mss <= r.incr {
+				r.cwnd++
+			}
+		}
+		if r.cwnd > info.RmtWnd {
+			r.cwnd = info.RmtWnd
+			r.incr = info.RmtWnd * mss
+		}
+	}
+}
+
+func (r *renoController) OnLoss(info *CongestionInfo, lost, fast uint32) {
+	resent := info.FastResend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+
+	// update ssthresh
+	// rate halving, https://tools.ietf.org/html/rfc6937
+	if fast > 0 {
+		r.ssthresh = info.Inflight / 2
+		if r.ssthresh < IKCP_THRESH_MIN {
+			r.ssthresh = IKCP_THRESH_MIN
+		}
+		r.cwnd = r.ssthresh + resent
+		r.incr = r.cwnd * info.Mss
+	}
+
+	// congestion control, https://tools.ietf.org/html/rfc5681
+	if lost > 0 {
+		r.ssthresh = r.window / 2
+		if r.ssthresh < IKCP_THRESH_MIN {
+			r.ssthresh = IKCP_THRESH_MIN
+		}
+		r.cwnd = 1
+		r.incr = info.Mss
+	}
+
+	if r.cwnd < 1 {
+		r.cwnd = 1
+		r.incr = info.Mss
+	}
+}
+
+func (r *renoController) OnFlush(info *CongestionInfo) uint32 {
+	r.window = _imin_(r.cwnd, _imin_(info.SndWnd, info.RmtWnd))
+	return r.cwnd
+}
+
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+const (
+	bbrBwRounds       = 10    // rounds of the max bandwidth filter
+	bbrMinRttExpiry   = 10000 // millisecs before min rtt is re-probed
+	bbrProbeRttTime   = 200   // millisecs to stay in probe rtt
+	bbrMinCwnd        = 4     // segments
+	bbrFullBwRounds   = 3     // rounds without growth to leave startup
+	bbrFullBwThresh   = 1.25  // growth expected per round in startup
+	bbrHighGain       = 2.885 // 2/ln(2)
+	bbrCwndGain       = 2
+	bbrGainCycleCount = 8
+)
+
+// pacing gains of a ProbeBW cycle, one phase per round
+var bbrPacingGains = [bbrGainCycleCount]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbrController is a BBR-style congestion controller, the window follows the
+// bandwidth-delay product estimated from the delivery rate and min RTT
+// rather than reacting to losses.
+type bbrController struct {
+	mode int
+	cwnd uint32
+	mss  uint32
+
+	// delivery rate, in segments per millisec, sampled once per round
+	delivered      uint64
+	round          uint64
+	roundStart     uint32
+	roundDelivered uint64
+	bwSamples      [bbrBwRounds]float64
+	maxBw          float64
+
+	// min rtt, a windowed minimum replaced by the samples of probe rtt
+	minRtt      uint32
+	minRttTs    uint32
+	probeRttMin uint32 // the smallest rtt sampled in probe rtt, 0 before any
+	interval    uint32 // flush interval, acks are aggregated over it
+
+	// startup
+	fullBw      float64
+	fullBwCount int
+
+	// probe bw & probe rtt
+	cycleIdx     int
+	probeRttDone uint32
+}
+
+// NewBBRController creates a BBR-style congestion controller driven by
+// delivery rate and min RTT
+func NewBBRController() CongestionController {
+	b := new(bbrController)
+	b.mode = bbrStartup
+	b.cwnd = bbrMinCwnd
+	return b
+}
+
+// bdp returns the estimated bandwidth-delay product in segments, the delay
+// includes a flush interval as segments and acks leave in batches per flush
+func (b *bbrController) bdp() float64 {
+	return b.maxBw * float64(b.minRtt+b.interval)
+}
+
+func (b *bbrController) OnAck(info *CongestionInfo, acked uint32, rtt int32) {
+	current := info.Current
+	b.interval = info.Interval
+	b.mss = info.Mss
+	if b.round == 0 && b.roundStart == 0 { // first ack starts the first round
+		b.roundStart = current
+		b.roundDelivered = b.delivered
+	}
+	b.delivered += uint64(acked)
+
+	// min rtt filter
+	if rtt >= 0 {
+		sample := uint32(rtt)
+		if sample == 0 {
+			sample = 1
+		}
+		if b.minRtt == 0 || sample <= b.minRtt {
+			b.minRtt = sample
+			b.minRttTs = current
+		}
+		if b.mode == bbrProbeRTT && (b.probeRttMin == 0 || sample < b.probeRttMin) {
+			b.probeRttMin = sample
+		}
+	}
+
+	// a round lasts one min rtt plus the flush interval,
+	// or srtt before we have a sample
+	roundTime := b.minRtt + b.interval
+	if b.minRtt == 0 {
+		roundTime = uint32(info.Srtt)
+	}
+	if elapsed := _itimediff(current, b.roundStart); elapsed > 0 && uint32(elapsed) >= roundTime {
+		b.bwSamples[b.round%bbrBwRounds] = float64(b.delivered-b.roundDelivered) / float64(elapsed)
+		b.maxBw = 0
+		for _, bw := range b.bwSamples {
+			if bw > b.maxBw {
+				b.maxBw = bw
+			}
+		}
+		b.round++
+		b.roundStart = current
+		b.roundDelivered = b.delivered
+		b.onRound(info)
+	}
+
+	// min rtt expired, drain the pipe to measure it again
+	if b.mode != bbrProbeRTT && b.minRtt > 0 && _itimediff(current, b.minRttTs) > bbrMinRttExpiry {
+		b.mode = bbrProbeRTT
+		b.probeRttDone = current + bbrProbeRttTime
+		b.probeRttMin = 0
+	}
+
+	// the min rtt of the drained pipe replaces the expired one, even if it's
+	// higher, as the path may have lengthened
+	if b.mode == bbrProbeRTT && _itimediff(current, b.probeRttDone) >= 0 {
+		if b.probeRttMin > 0 {
+			b.minRtt = b.probeRttMin
+		}
+		b.minRttTs = current
+		if b.fullBwCount >= bbrFullBwRounds {
+			b.mode = bbrProbeBW
+		} else {
+			b.mode = bbrStartup
+		}
+	}
+
+	b.updateCwnd(acked)
+}
+
+// onRound runs the state machine once per round trip
+func (b *bbrController) onRound(info *CongestionInfo) {
+	switch b.mode {
+	case bbrStartup:
+		if b.maxBw >= b.fullBw*bbrFullBwThresh {
+			b.fullBw = b.maxBw
+			b.fullBwCount = 0
+		} else {
+			b.fullBwCount++
+			if b.fullBwCount >= bbrFullBwRounds {
+				b.mode = bbrDrain
+			}
+		}
+	case bbrDrain:
+		if float64(info.Inflight) <= b.bdp() {
+			b.mode = bbrProbeBW
+			b.cycleIdx = 0
+		}
+	case bbrProbeBW:
+		b.cycleIdx = (b.cycleIdx + 1) % bbrGainCycleCount
+	}
+}
+
+func (b *bbrController) updateCwnd(acked uint32) {
+	var target float64
+	switch b.mode {
+	case bbrStartup:
+		target = b.bdp() * bbrHighGain
+	case bbrDrain:
+		target = b.bdp()
+	case bbrProbeBW:
+		target = b.bdp() * bbrCwndGain * bbrPacingGains[b.cycleIdx]
+	case bbrProbeRTT:
+		b.cwnd = bbrMinCwnd
+		return
+	}
+
+	if b.fullBwCount >= bbrFullBwRounds { // pipe filled, follow the target
+		b.cwnd = _imin_(b.cwnd+acked, uint32(target))
+	} else if b.maxBw == 0 || float64(b.cwnd) < target { // grow like slow start
+		b.cwnd += acked
+	}
+	if b.cwnd < bbrMinCwnd {
+		b.cwnd = bbrMinCwnd
+	}
+}
+
+// pacingGain returns the gain applied to the bandwidth estimate for pacing
+func (b *bbrController) pacingGain() float64 {
+	switch b.mode {
+	case bbrStartup:
+		return bbrHighGain
+	case bbrDrain:
+		return 1 / bbrHighGain
+	case bbrProbeBW:
+		return bbrPacingGains[b.cycleIdx]
+	}
+	return 1
+}
+
+// PacingRate implements PacingRater
+func (b *bbrController) PacingRate() uint64 {
+	return uint64(b.maxBw * 1000 * float64(b.mss+IKCP_OVERHEAD) * b.pacingGain())
+}
+
+func (b *bbrController) OnLoss(info *CongestionInfo, lost, fast uint32) {}
+
+func (b *bbrController) OnFlush(info *CongestionInfo) uint32 { return b.cwnd }
@@ -0,0 +1,44 @@
+package kcp
+
+import "testing"
+
+// the min rtt follows a path whose rtt has gone up, once the old minimum
+// expires and probe rtt has measured the new one
+func TestBBRMinRttWindowed(t *testing.T) {
+	b := NewBBRController().(*bbrController)
+	info := &CongestionInfo{Mss: 1400, Interval: 10, Srtt: 10}
+
+	ack := func(rtt int32) {
+		info.Current += 10
+		b.OnAck(info, 1, rtt)
+	}
+	for i := 0; i < 100; i++ {
+		ack(10)
+	}
+	if b.minRtt != 10 {
+		t.Fatalf("minRtt %v, want 10", b.minRtt)
+	}
+
+	// the path lengthens, the old minimum is kept until it expires
+	for info.Current < 3*bbrMinRttExpiry && b.mode != bbrProbeRTT {
+		ack(100)
+	}
+	if b.mode != bbrProbeRTT {
+		t.Fatal("min rtt not re-probed")
+	}
+	if b.minRtt != 10 {
+		t.Fatalf("minRtt %v before probe rtt ends, want 10", b.minRtt)
+	}
+	for b.mode == bbrProbeRTT {
+		ack(100)
+	}
+	if b.minRtt != 100 {
+		t.Fatalf("minRtt %v after probe rtt, want 100", b.minRtt)
+	}
+
+	// a shorter path is taken at once
+	ack(50)
+	if b.minRtt != 50 {
+		t.Fatalf("minRtt %v, want 50", b.minRtt)
+	}
+}
@@ -44,3 +44,14 @@ func NewNoneBlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *noneBlockCrypt) Encrypt(dst, src []byte) { copy(dst, src) }
 func (c *noneBlockCrypt) Decrypt(dst, src []byte) { copy(dst, src) }
+
+// authenticated reports whether a packet decrypted by 'block' with a valid
+// CRC comes from a holder of the key. The CRC of a packet sent in the clear,
+// without a BlockCrypt or with noneBlockCrypt, can be forged by anyone.
+func authenticated(block BlockCrypt) bool {
+	if block == nil {
+		return false
+	}
+	_, none := block.(*noneBlockCrypt)
+	return !none
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package kcp
+
+import "net"
+
+// setDF is only supported on linux
+func setDF(conn net.PacketConn) error {
+	return errInvalidOperation
+}
@@ -0,0 +1,37 @@
+// +build linux
+
+package kcp
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDF sets the DF bit on the packets of a UDP connection, the kernel
+// neither fragments them nor lowers its path mtu cache on ICMP errors,
+// so that probes larger than the path mtu are dropped on the way
+func setDF(conn net.PacketConn) error {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return errInvalidOperation
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err4, err6 error
+	if err := rc.Control(func(fd uintptr) {
+		err4 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		err6 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	}); err != nil {
+		return err
+	}
+
+	// either succeeds on a socket of one address family, both on a dual-stack socket
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
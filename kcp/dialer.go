@@ -0,0 +1,196 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the handshake packets of a conv queued by the read loop of a Dialer
+const dialerHandshakeBacklog = 8
+
+// Dialer establishes sessions sharing one packet connection, the packets read
+// from it are dispatched to the sessions by conv. The sessions of a Dialer
+// share a single NAT mapping and read loop, and don't close the connection.
+type Dialer struct {
+	conn         net.PacketConn // the shared packet connection
+	block        BlockCrypt
+	dataShards   int
+	parityShards int
+	headerSize   int // the additional header to a KCP frame
+
+	sessions    map[uint32]*UDPSession // established sessions, by conv
+	handshakes  map[uint32]chan []byte // the handshake packets of the sessions being dialed, by conv
+	sessionLock sync.Mutex
+	die         chan struct{} // notify the dialer has closed
+	dieOnce     sync.Once
+
+	// the read error of the connection, returned by Dial and the sessions
+	chSocketReadError   chan struct{}
+	socketReadError     atomic.Value
+	socketReadErrorOnce sync.Once
+}
+
+// NewDialer creates a Dialer over a packet connection, which is closed by
+// Dialer.Close
+func NewDialer(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) *Dialer {
+	useMTULimit()
+	d := new(Dialer)
+	d.conn = conn
+	d.block = block
+	d.dataShards = dataShards
+	d.parityShards = parityShards
+	d.sessions = make(map[uint32]*UDPSession)
+	d.handshakes = make(map[uint32]chan []byte)
+	d.die = make(chan struct{})
+	d.chSocketReadError = make(chan struct{})
+
+	if block != nil {
+		d.headerSize += cryptHeaderSize
+	}
+	if dataShards > 0 && parityShards > 0 {
+		d.headerSize += fecHeaderSizePlus2
+	}
+
+	go d.monitor()
+	return d
+}
+
+// Dial establishes a session with the server at "raddr" over the connection
+// of the dialer, it returns once the server has accepted the session, or
+// ErrHandshakeTimeout if the server hasn't answered in 10 seconds. The
+// addresses of a host name are tried in parallel as by DialWithOptions, the
+// connection must be able to reach them, a dual-stack socket reaches both
+// address families.
+func (d *Dialer) Dial(raddr string) (*UDPSession, error) {
+	return dialParallel(raddr, d.dial)
+}
+
+// dial establishes a session with 'raddr', giving up once 'cancel' is closed,
+// a conv the server rejects as in use is replaced by a new one
+func (d *Dialer) dial(raddr *net.UDPAddr, cancel <-chan struct{}) (*UDPSession, error) {
+	for try := 1; ; try++ {
+		sess, err := d.dialConv(raddr, cancel)
+		if err != ErrConvInUse || try == handshakeConvTries {
+			return sess, err
+		}
+	}
+}
+
+// dialConv runs the handshake of a new conv with 'raddr'
+func (d *Dialer) dialConv(raddr *net.UDPAddr, cancel <-chan struct{}) (*UDPSession, error) {
+	// a conv unique among the sessions of the dialer
+	var convid uint32
+	ch := make(chan []byte, dialerHandshakeBacklog)
+	d.sessionLock.Lock()
+	for {
+		binary.Read(rand.Reader, binary.LittleEndian, &convid)
+		_, established := d.sessions[convid]
+		_, dialing := d.handshakes[convid]
+		if !established && !dialing {
+			break
+		}
+	}
+	d.handshakes[convid] = ch
+	d.sessionLock.Unlock()
+
+	clock := connClock(d.conn)
+	recv := func(wait time.Time) ([]byte, error) {
+		timeout, stop := after(clock, wait.Sub(clock.Now()))
+		defer stop()
+		select {
+		case data := <-ch:
+			return data, nil
+		case <-timeout:
+			return nil, nil
+		case <-cancel:
+			return nil, errCanceled
+		case <-d.chSocketReadError:
+			return nil, errors.Wrap(d.socketReadError.Load().(error), "ReadFrom")
+		case <-d.die:
+			return nil, errBrokenPipe
+		}
+	}
+	fec := d.dataShards > 0 && d.parityShards > 0
+	err := runHandshake(d.conn, raddr, convid, d.block, fec, recv)
+
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+	delete(d.handshakes, convid)
+	if err != nil {
+		return nil, err
+	}
+	sess := newUDPSession(convid, d.dataShards, d.parityShards, nil, d, d.conn, raddr, d.block)
+	d.sessions[convid] = sess
+	return sess, nil
+}
+
+// Sessions returns the sessions of the dialer not closed yet
+func (d *Dialer) Sessions() []*UDPSession {
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+	sessions := make([]*UDPSession, 0, len(d.sessions))
+	for _, s := range d.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// closeSession notify the dialer that a session has closed
+func (d *Dialer) closeSession(s *UDPSession) {
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+	if d.sessions[s.kcp.conv] == s {
+		delete(d.sessions, s.kcp.conv)
+	}
+}
+
+// notifyReadError records the read error of the connection, and passes it
+// to the sessions
+func (d *Dialer) notifyReadError(err error) {
+	d.socketReadErrorOnce.Do(func() {
+		d.socketReadError.Store(err)
+		close(d.chSocketReadError)
+	})
+	for _, s := range d.Sessions() {
+		select {
+		case s.chReadError <- err:
+		default:
+		}
+	}
+}
+
+// LocalAddr returns the local network address of the shared connection
+func (d *Dialer) LocalAddr() net.Addr { return d.conn.LocalAddr() }
+
+// SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in
+// IPv6 header, of the shared connection
+func (d *Dialer) SetDSCP(dscp int) error { return setConnDSCP(d.conn, dscp) }
+
+// SetReadBuffer sets the socket read buffer of the shared connection
+func (d *Dialer) SetReadBuffer(bytes int) error {
+	if nc, ok := d.conn.(setReadBuffer); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// SetWriteBuffer sets the socket write buffer of the shared connection
+func (d *Dialer) SetWriteBuffer(bytes int) error {
+	if nc, ok := d.conn.(setWriteBuffer); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// Close closes the shared connection, the sessions of the dialer get the
+// read error of the closed connection.
+func (d *Dialer) Close() error {
+	d.dieOnce.Do(func() { close(d.die) })
+	return d.conn.Close()
+}
@@ -0,0 +1,173 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the delay before the next address is tried while an attempt is running, RFC 8305
+const fallbackDelay = 250 * time.Millisecond
+
+var errCanceled = errors.New("canceled")
+
+// dialParallel establishes a session with "raddr" in the way of happy
+// eyeballs, RFC 8305. The host is resolved to all its addresses, which are
+// tried alternating the address families, IPv6 first. The next address is
+// tried once the running attempts have failed or after fallbackDelay, and the
+// first session established is kept. 'dial' establishes a session with an
+// address, giving up once 'cancel' is closed.
+func dialParallel(raddr string, dial func(raddr *net.UDPAddr, cancel <-chan struct{}) (*UDPSession, error)) (*UDPSession, error) {
+	host, port, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.SplitHostPort")
+	}
+	portnum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.LookupPort")
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.LookupIPAddr")
+	}
+	addrs := interleaveAddrs(ips, portnum)
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no address for %v", host)
+	}
+
+	type result struct {
+		sess *UDPSession
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	cancel := make(chan struct{})
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	next, running := 0, 0
+	start := func() {
+		addr := addrs[next]
+		go func() {
+			sess, err := dial(addr, cancel)
+			results <- result{sess, err}
+		}()
+		next++
+		running++
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(fallbackDelay)
+	}
+
+	start()
+	var firstErr error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// the sessions established meanwhile by the other attempts are closed
+				close(cancel)
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.sess != nil {
+							r.sess.Close()
+						}
+					}
+				}(running)
+				return r.sess, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveAddrs orders the addresses alternating IPv6 and IPv4, in the
+// order of the resolver within a family
+func interleaveAddrs(ips []net.IPAddr, port int) []*net.UDPAddr {
+	var v6, v4 []*net.UDPAddr
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
+
+// listenUDP opens an unconnected UDP socket of the address family of 'raddr'
+func listenUDP(raddr *net.UDPAddr) (net.PacketConn, error) {
+	network := "udp4"
+	if raddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUDP")
+	}
+	return conn, nil
+}
+
+// DialDualStack establishes a session with "raddr" as DialWithOptions does,
+// trying all the addresses of the host in parallel, over a packet connection
+// to each of them opened by 'dial'. The connections of the failed attempts
+// are closed.
+func DialDualStack(raddr string, block BlockCrypt, dataShards, parityShards int, dial func(raddr *net.UDPAddr) (net.PacketConn, error)) (*UDPSession, error) {
+	return dialParallel(raddr, func(addr *net.UDPAddr, cancel <-chan struct{}) (*UDPSession, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// the handshake reading the connection fails once it's closed. The
+		// watcher has exited by the time the attempt returns, as 'cancel' is
+		// closed once a session is established, which must be kept.
+		done := make(chan struct{})
+		exited := make(chan struct{})
+		defer func() {
+			close(done)
+			<-exited
+		}()
+		go func() {
+			defer close(exited)
+			select {
+			case <-cancel:
+				conn.Close()
+			case <-done:
+			}
+		}()
+
+		sess, err := NewConn(addr.String(), block, dataShards, parityShards, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return sess, nil
+	})
+}
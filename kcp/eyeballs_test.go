@@ -0,0 +1,59 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closeConn records whether a socket has been closed
+type closeConn struct {
+	net.PacketConn
+	closed int32
+}
+
+func (c *closeConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.PacketConn.Close()
+}
+
+// the connection of the session established is never closed by the
+// cancellation of the other attempts
+func TestDialDualStackKeepsWinner(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.Close()
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		var conn *closeConn
+		sess, err := DialDualStack(l.Addr().String(), nil, 0, 0, func(raddr *net.UDPAddr) (net.PacketConn, error) {
+			raw, err := listenUDP(raddr)
+			if err != nil {
+				return nil, err
+			}
+			conn = &closeConn{PacketConn: raw}
+			return conn, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // for the cancellation to run
+		closed := atomic.LoadInt32(&conn.closed)
+		sess.Close()
+		if closed != 0 {
+			t.Fatal("connection of the session closed at attempt", i)
+		}
+	}
+}
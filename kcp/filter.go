@@ -0,0 +1,144 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptFilter decides whether the listener accepts a new session of 'conv'
+// from 'remote'. It's consulted once the client has proven its address in the
+// handshake, before any session is allocated for it.
+type AcceptFilter func(remote net.Addr, conv uint32) bool
+
+// SetAcceptFilter sets the filter of the new sessions, nil accepts all of
+// them. The filters are run one at a time, so a filter counting the sessions
+// of the listener sees those it has accepted before.
+func (l *Listener) SetAcceptFilter(filter AcceptFilter) {
+	l.acceptFilter.Store(filter)
+}
+
+// admit runs the accept filter for a new session
+func (l *Listener) admit(remote net.Addr, conv uint32) bool {
+	filter, _ := l.acceptFilter.Load().(AcceptFilter)
+	return filter == nil || filter(remote, conv)
+}
+
+// ChainAcceptFilters returns a filter accepting the sessions accepted by all
+// of 'filters', they are run in order until one of them refuses. A filter
+// with a cost on accepting, like NewSessionRateLimiter, goes last, so that a
+// session refused by the others costs nothing.
+func ChainAcceptFilters(filters ...AcceptFilter) AcceptFilter {
+	return func(remote net.Addr, conv uint32) bool {
+		for _, filter := range filters {
+			if !filter(remote, conv) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MaxSessions returns a filter refusing new sessions while the listener has
+// 'n' sessions or more, including those lingering after Close
+func (l *Listener) MaxSessions(n int) AcceptFilter {
+	return func(remote net.Addr, conv uint32) bool {
+		l.sessionLock.Lock()
+		defer l.sessionLock.Unlock()
+		return len(l.sessions) < n
+	}
+}
+
+// MaxSessionsPerIP returns a filter refusing new sessions from an IP while
+// the listener has 'n' sessions or more from the same IP
+func (l *Listener) MaxSessionsPerIP(n int) AcceptFilter {
+	return func(remote net.Addr, conv uint32) bool {
+		ip := addrIP(remote)
+		count := 0
+		for _, s := range l.Sessions() {
+			if addrIP(s.RemoteAddr()) == ip {
+				count++
+			}
+		}
+		return count < n
+	}
+}
+
+// sessionRateLimiter is a token bucket per IP
+type sessionRateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+	sweepTs time.Time // last time the full buckets were removed
+	mu      sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	ts     time.Time // last time the bucket was filled
+}
+
+// NewSessionRateLimiter returns a filter limiting the new sessions from an
+// IP to 'rate' per second, with bursts of up to 'burst' sessions, both must
+// be positive. Every session it accepts spends a token, whether or not the
+// session is created, so it must be the last of ChainAcceptFilters for the
+// sessions refused by the other filters not to be charged.
+func NewSessionRateLimiter(rate float64, burst int) AcceptFilter {
+	r := new(sessionRateLimiter)
+	r.rate = rate
+	r.burst = float64(burst)
+	r.buckets = make(map[string]*tokenBucket)
+	r.sweepTs = time.Now()
+	return r.allow
+}
+
+func (r *sessionRateLimiter) allow(remote net.Addr, conv uint32) bool {
+	ip := addrIP(remote)
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// a bucket filled up again is the same as no bucket, the buckets are
+	// removed after the time to fill one, so the map doesn't grow forever
+	if refill := time.Duration(r.burst / r.rate * float64(time.Second)); now.Sub(r.sweepTs) > refill {
+		for k, b := range r.buckets {
+			if now.Sub(b.ts) > refill {
+				delete(r.buckets, k)
+			}
+		}
+		r.sweepTs = now
+	}
+
+	b, ok := r.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, ts: now}
+		r.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.ts).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.ts = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// addrIP returns the IP of an address as a string, or the whole address if
+// it has no IP
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,29 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+)
+
+// a rate limiter chained last is not charged for the sessions refused by
+// the filters before it
+func TestChainAcceptFiltersRateLimiterLast(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	full := true
+	maxSessions := func(remote net.Addr, conv uint32) bool { return !full }
+	limiter := NewSessionRateLimiter(0.001, 1)
+	filter := ChainAcceptFilters(maxSessions, limiter)
+
+	for i := 0; i < 10; i++ {
+		if filter(remote, 1) {
+			t.Fatal("accepted while full")
+		}
+	}
+	full = false
+	if !filter(remote, 1) {
+		t.Fatal("token spent on refused sessions")
+	}
+	if filter(remote, 1) {
+		t.Fatal("rate not limited")
+	}
+}
@@ -0,0 +1,409 @@
+package kcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// a cookie is the time it was issued followed by a truncated HMAC
+	cookieMacSize = 16
+	cookieSize    = 4 + cookieMacSize
+
+	// a cookie is accepted for this long after it was issued
+	cookieLifetime = 30 * time.Second
+
+	// the client gives up the handshake after this duration
+	handshakeTimeout = 10 * time.Second
+
+	// the first retransmission timeout of the handshake, doubled on every try
+	handshakeRTO = 250 * time.Millisecond
+
+	// the convs a client tries while the server rejects them as in use
+	handshakeConvTries = 3
+)
+
+// a deadline in the past, interrupting a blocked read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ErrHandshakeTimeout is returned by NewConn and DialWithOptions when the
+// server hasn't accepted the session in time
+var ErrHandshakeTimeout = errors.New("handshake timeout")
+
+// ErrConvInUse is returned by NewConn and DialWithOptions when the server
+// has rejected every conv tried, as sessions of other clients hold them
+var ErrConvInUse = errors.New("conv in use")
+
+// The handshake establishes a conv before any session is created:
+//
+//	client                                    server
+//	HELLO(conv, padding)        ---->
+//	                            <----  COOKIE(conv, cookie)
+//	CONFIRM(conv, cookie)       ---->  creates the session
+//	                            <----  ACCEPT(conv)
+//
+// A session of another client may hold the conv, which is picked at random.
+// The server then answers a CONFIRM with a valid cookie with REJECT(conv),
+// and the client starts over with a new conv unless an ACCEPT follows.
+//
+// The server keeps no state until the cookie comes back, which proves the
+// client receives at its source address. The cookie is an HMAC of the conv,
+// the client address and the issuing time under a random key of the
+// listener. The HELLO is padded to the size of the COOKIE, so the server
+// never answers with more bytes than it has received.
+//
+// The handshake packets are single KCP frames of the conv, carrying the cookie
+// as the data, sent outside of the FEC groups. The path probes are framed the
+// same way, a PING is echoed as a PONG to the address and socket it came
+// from, never answering more bytes than it has received. A MultipathConn
+// probes its paths so once its session is established, the listener echoes
+// the PINGs of the conv of a session only, so it doesn't reflect packets to
+// anyone. The listener also
+// challenges a new path of a session with a PING before migrating to it, the
+// MultipathConn echoes it on that path.
+
+// handshakeEncoder builds the handshake packets outside of a session
+type handshakeEncoder struct {
+	block      BlockCrypt
+	fec        bool
+	headerSize int
+	nonce      nonceMD5
+	mu         sync.Mutex // guards nonce, the listener shards encode concurrently
+}
+
+func newHandshakeEncoder(block BlockCrypt, fec bool) *handshakeEncoder {
+	e := new(handshakeEncoder)
+	e.block = block
+	e.fec = fec
+	if block != nil {
+		e.headerSize += cryptHeaderSize
+	}
+	if fec {
+		e.headerSize += fecHeaderSizePlus2
+	}
+	return e
+}
+
+// encode builds a handshake packet into 'buf' and returns it
+func (e *handshakeEncoder) encode(buf []byte, conv uint32, cmd uint8, payload []byte) []byte {
+	buf = buf[:e.headerSize+IKCP_OVERHEAD+len(payload)]
+	var seg segment
+	seg.conv = conv
+	seg.cmd = cmd
+	seg.data = payload
+	copy(seg.encode(buf[e.headerSize:]), payload)
+
+	if e.fec {
+		fec := buf[e.headerSize-fecHeaderSizePlus2:]
+		binary.LittleEndian.PutUint32(fec, 0)
+		binary.LittleEndian.PutUint16(fec[4:], typeRaw)
+		binary.LittleEndian.PutUint16(fec[fecHeaderSize:], uint16(len(fec[fecHeaderSize:])))
+	}
+
+	if e.block != nil {
+		e.mu.Lock()
+		e.nonce.Fill(buf[:nonceSize])
+		e.mu.Unlock()
+		checksum := crc32.ChecksumIEEE(buf[cryptHeaderSize:])
+		binary.LittleEndian.PutUint32(buf[nonceSize:], checksum)
+		e.block.Encrypt(buf, buf)
+	}
+	return buf
+}
+
+// writeTo sends a handshake packet to 'addr'
+func (e *handshakeEncoder) writeTo(conn net.PacketConn, addr net.Addr, conv uint32, cmd uint8, payload []byte) error {
+	buf := xmitBuf.Get().([]byte)
+	defer xmitBuf.Put(buf)
+	_, err := conn.WriteTo(e.encode(buf, conv, cmd, payload), addr)
+	return err
+}
+
+// decryptPacket decrypts a packet and verifies its checksum, it returns
+// the packet without the crypto header
+func decryptPacket(block BlockCrypt, data []byte) ([]byte, bool) {
+	if block == nil {
+		return data, true
+	}
+	block.Decrypt(data, data)
+	data = data[nonceSize:]
+	checksum := crc32.ChecksumIEEE(data[crcSize:])
+	if checksum != binary.LittleEndian.Uint32(data) {
+		return nil, false
+	}
+	return data[crcSize:], true
+}
+
+// parseHandshake returns the conv, command and payload of a decrypted packet
+// if it's a handshake packet or a path probe
+func parseHandshake(data []byte, fec bool) (conv uint32, cmd uint8, payload []byte, ok bool) {
+	if fec {
+		if len(data) < fecHeaderSizePlus2 || binary.LittleEndian.Uint16(data[4:]) != typeRaw {
+			return
+		}
+		data = data[fecHeaderSizePlus2:]
+	}
+	if len(data) < IKCP_OVERHEAD {
+		return
+	}
+	cmd = data[4]
+	if (cmd < IKCP_CMD_HELLO || cmd > IKCP_CMD_ACCEPT) && cmd != IKCP_CMD_PING && cmd != IKCP_CMD_PONG && cmd != IKCP_CMD_REJECT {
+		return
+	}
+	length := binary.LittleEndian.Uint32(data[20:])
+	if uint64(length) > uint64(len(data)-IKCP_OVERHEAD) {
+		return
+	}
+	return binary.LittleEndian.Uint32(data), cmd, data[IKCP_OVERHEAD : IKCP_OVERHEAD+length], true
+}
+
+// dialHandshake runs the client side of the handshake of 'conv' with the
+// server at 'remote', reading the connection until the server accepts
+func dialHandshake(conn net.PacketConn, remote net.Addr, conv uint32, block BlockCrypt, fec bool) error {
+	useMTULimit()
+	defer conn.SetReadDeadline(time.Time{})
+	clock := connClock(conn)
+	headerSize := newHandshakeEncoder(block, fec).headerSize
+	buf := make([]byte, mtuLimit)
+	recv := func(wait time.Time) ([]byte, error) {
+		// the read is interrupted by a deadline in the past once 'wait'
+		// has passed on the clock, which may not be the real time
+		var mu sync.Mutex
+		done := false
+		conn.SetReadDeadline(time.Time{})
+		stop := afterFunc(clock, wait.Sub(clock.Now()), func() {
+			mu.Lock()
+			if !done {
+				conn.SetReadDeadline(aLongTimeAgo)
+			}
+			mu.Unlock()
+		})
+		defer func() {
+			mu.Lock()
+			done = true
+			mu.Unlock()
+			stop()
+		}()
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				// not every connection returns a net.Error on timeout
+				if clock.Now().Before(wait) {
+					return nil, errors.Wrap(err, "ReadFrom")
+				}
+				return nil, nil
+			}
+			if n < headerSize+IKCP_OVERHEAD {
+				continue
+			}
+			if data, ok := decryptPacket(block, buf[:n]); ok {
+				return data, nil
+			}
+		}
+	}
+	return runHandshake(conn, remote, conv, block, fec, recv)
+}
+
+// runHandshake runs the client side of the handshake of 'conv', 'recv' returns
+// the next decrypted packet received before 'wait' on the clock of 'conn', or
+// nil once it's passed. A COOKIE received while confirming replaces the
+// cookie, as the previous one may have expired. It returns ErrConvInUse if
+// the server rejects the conv and doesn't accept it before the retransmission,
+// the accept of a MultipathConn may come over another path than the reject.
+func runHandshake(conn net.PacketConn, remote net.Addr, conv uint32, block BlockCrypt, fec bool, recv func(wait time.Time) ([]byte, error)) error {
+	clock := connClock(conn)
+	enc := newHandshakeEncoder(block, fec)
+	cmd := uint8(IKCP_CMD_HELLO)
+	payload := make([]byte, cookieSize) // padding to the size of the COOKIE
+	deadline := clock.Now().Add(handshakeTimeout)
+	rto := handshakeRTO
+	rejected := false
+	for {
+		if err := enc.writeTo(conn, remote, conv, cmd, payload); err != nil {
+			return errors.Wrap(err, "WriteTo")
+		}
+		wait := clock.Now().Add(rto)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+
+		resend := false
+		for !resend {
+			data, err := recv(wait)
+			if err != nil {
+				return err
+			} else if data == nil {
+				break
+			}
+			c, answer, p, ok := parseHandshake(data, fec)
+			if !ok || c != conv {
+				continue
+			}
+			switch answer {
+			case IKCP_CMD_COOKIE:
+				if len(p) == cookieSize {
+					cmd = IKCP_CMD_CONFIRM
+					payload = append(payload[:0], p...)
+					rto = handshakeRTO
+					resend = true
+				}
+			case IKCP_CMD_ACCEPT:
+				if cmd == IKCP_CMD_CONFIRM {
+					return nil
+				}
+			case IKCP_CMD_REJECT:
+				rejected = rejected || cmd == IKCP_CMD_CONFIRM
+			}
+		}
+
+		if !resend {
+			if rejected {
+				return ErrConvInUse
+			}
+			if !clock.Now().Before(deadline) {
+				return ErrHandshakeTimeout
+			}
+			rto *= 2
+		}
+	}
+}
+
+// newCookieKey generates the key of the cookies of a listener
+func newCookieKey() []byte {
+	key := make([]byte, sha256.Size)
+	io.ReadFull(rand.Reader, key)
+	return key
+}
+
+// cookieMAC computes the MAC of a cookie issued at 'ts' for 'conv' and 'addr'
+func (l *Listener) cookieMAC(conv uint32, addr net.Addr, ts uint32) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[:], conv)
+	binary.LittleEndian.PutUint32(b[4:], ts)
+	mac := hmac.New(sha256.New, l.cookieKey)
+	mac.Write(b[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:cookieMacSize]
+}
+
+// newCookie issues a cookie for 'conv' and 'addr'
+func (l *Listener) newCookie(conv uint32, addr net.Addr) []byte {
+	ts := uint32(l.clock.Now().Unix())
+	cookie := make([]byte, 4, cookieSize)
+	binary.LittleEndian.PutUint32(cookie, ts)
+	return append(cookie, l.cookieMAC(conv, addr, ts)...)
+}
+
+// verifyCookie checks a cookie has been issued for 'conv' and 'addr' by this
+// listener, and hasn't expired
+func (l *Listener) verifyCookie(conv uint32, addr net.Addr, cookie []byte) bool {
+	if len(cookie) != cookieSize {
+		return false
+	}
+	ts := binary.LittleEndian.Uint32(cookie)
+	age := l.clock.Now().Sub(time.Unix(int64(ts), 0))
+	if age < -time.Second || age > cookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie[4:], l.cookieMAC(conv, addr, ts))
+}
+
+// handshake answers a handshake packet of 'conv' received from 'addr' on the
+// shard 'conn', a session is created once the client confirms with a valid
+// cookie. A confirm for an existing session is answered again, in case the
+// accept has been lost, or rejected if it comes from another client. A path
+// probe of a session is echoed, the echo of the challenge of a session
+// migrates it.
+func (l *Listener) handshake(conv uint32, cmd uint8, payload []byte, addr net.Addr, conn net.PacketConn) {
+	switch cmd {
+	case IKCP_CMD_PING:
+		l.sessionLock.Lock()
+		_, ok := l.sessions[conv]
+		l.sessionLock.Unlock()
+		if ok {
+			l.hsEncoder.writeTo(conn, addr, conv, IKCP_CMD_PONG, payload)
+		}
+	case IKCP_CMD_PONG:
+		l.sessionLock.Lock()
+		s, ok := l.sessions[conv]
+		l.sessionLock.Unlock()
+		if ok && s.challengeAnswered(payload, addr, conn) {
+			l.sessionPathsChanged(s)
+		}
+	case IKCP_CMD_HELLO:
+		if len(payload) >= cookieSize {
+			l.hsEncoder.writeTo(conn, addr, conv, IKCP_CMD_COOKIE, l.newCookie(conv, addr))
+		}
+	case IKCP_CMD_CONFIRM:
+		l.sessionLock.Lock()
+		s, ok := l.sessions[conv]
+		l.sessionLock.Unlock()
+		if ok {
+			if s.RemoteAddr().String() == addr.String() {
+				l.hsEncoder.writeTo(conn, addr, conv, IKCP_CMD_ACCEPT, nil)
+			} else {
+				l.rejectConv(s, conv, payload, addr, conn)
+			}
+			return
+		}
+
+		if !l.verifyCookie(conv, addr, payload) {
+			return
+		}
+
+		// do not let the new sessions overwhelm accept queue, and a refused
+		// source costs no session
+		l.admitLock.Lock()
+		defer l.admitLock.Unlock()
+		if len(l.chAccepts) >= cap(l.chAccepts) || !l.admit(addr, conv) {
+			return
+		}
+
+		// no session is created once the listener is closed, the check and
+		// the creation are atomic for Shutdown to see every session
+		l.sessionLock.Lock()
+		select {
+		case <-l.die:
+			l.sessionLock.Unlock()
+			return
+		default:
+		}
+		if s, ok := l.sessions[conv]; ok { // confirmed meanwhile
+			l.sessionLock.Unlock()
+			if s.RemoteAddr().String() != addr.String() {
+				l.rejectConv(s, conv, payload, addr, conn)
+			}
+			return
+		}
+		s = newUDPSession(conv, l.dataShards, l.parityShards, l, nil, conn, addr, l.block)
+		l.sessions[conv] = s
+		l.sessionsByAddr[addr.String()] = s
+		l.sessionLock.Unlock()
+		l.hsEncoder.writeTo(conn, addr, conv, IKCP_CMD_ACCEPT, nil)
+		l.chAccepts <- s
+	}
+}
+
+// rejectConv answers the confirm of 'conv' from 'addr', whose session 's' is
+// that of another client. The cookie proves the client receives at 'addr',
+// and a path of 's' is left alone, as a client may confirm over several.
+func (l *Listener) rejectConv(s *UDPSession, conv uint32, cookie []byte, addr net.Addr, conn net.PacketConn) {
+	if !l.verifyCookie(conv, addr, cookie) {
+		return
+	}
+	for _, known := range s.pathAddrs() {
+		if known == addr.String() {
+			return
+		}
+	}
+	l.hsEncoder.writeTo(conn, addr, conv, IKCP_CMD_REJECT, nil)
+}
@@ -0,0 +1,48 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+)
+
+// a conv held by the session of another client is rejected, while the
+// client of the session is accepted again
+func TestConvInUse(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var clients [2]net.PacketConn
+	for k := range clients {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients[k] = conn
+	}
+
+	tests := []struct {
+		name   string
+		client int
+		err    error
+	}{
+		{"new", 0, nil},
+		{"same client", 0, nil},
+		{"other client", 1, ErrConvInUse},
+	}
+	for _, tt := range tests {
+		if err := dialHandshake(clients[tt.client], l.Addr(), 7, nil, false); err != tt.err {
+			t.Fatalf("%v: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// the other client is served with a conv of its own
+	s, err := NewConn(l.Addr().String(), nil, 0, 0, clients[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -3,6 +3,7 @@ package kcp
 
 import (
 	"encoding/binary"
+	"sync/atomic"
 )
 
 const (
@@ -14,8 +15,21 @@ const (
 	IKCP_CMD_ACK     = 82 // cmd: ack
 	IKCP_CMD_WASK    = 83 // cmd: window probe (ask)
 	IKCP_CMD_WINS    = 84 // cmd: window size (tell)
+	IKCP_CMD_PMTU    = 85 // cmd: path mtu probe
+	IKCP_CMD_PMTU_OK = 86 // cmd: path mtu probe received
+	IKCP_CMD_HELLO   = 87 // cmd: handshake, client hello
+	IKCP_CMD_COOKIE  = 88 // cmd: handshake, server cookie
+	IKCP_CMD_CONFIRM = 89 // cmd: handshake, client confirm with the cookie
+	IKCP_CMD_ACCEPT  = 90 // cmd: handshake, server accept
+	IKCP_CMD_ALIVE   = 91 // cmd: keepalive
+	IKCP_CMD_DGRAM   = 92 // cmd: unreliable datagram
+	IKCP_CMD_FIN     = 93 // cmd: end of the data, in sequence
+	IKCP_CMD_PING    = 94 // cmd: multipath, path probe
+	IKCP_CMD_PONG    = 95 // cmd: multipath, path probe echoed
+	IKCP_CMD_REJECT  = 96 // cmd: handshake, server rejects a conv in use
 	IKCP_ASK_SEND    = 1  // need to send IKCP_CMD_WASK
 	IKCP_ASK_TELL    = 2  // need to send IKCP_CMD_WINS
+	IKCP_ASK_ALIVE   = 4  // need to send IKCP_CMD_ALIVE
 	IKCP_WND_SND     = 32
 	IKCP_WND_RCV     = 32
 	IKCP_MTU_DEF     = 1400
@@ -29,6 +43,9 @@ const (
 	IKCP_PROBE_LIMIT = 120000 // up to 120 secs to probe window
 )
 
+// the fragments of a message are numbered down to 0 in the uint8 frg field
+const maxFragments = 255
+
 // output_callback is a prototype which ought capture conn and call conn.Write
 type output_callback func(buf []byte, size int)
 
@@ -124,27 +141,47 @@ func (seg *segment) encode(ptr []byte) []byte {
 type KCP struct {
 	conv, mtu, mss, state                  uint32
 	snd_una, snd_nxt, rcv_nxt              uint32
-	ssthresh                               uint32
 	rx_rttvar, rx_srtt                     int32
 	rx_rto, rx_minrto                      uint32
 	snd_wnd, rcv_wnd, rmt_wnd, cwnd, probe uint32
 	interval, ts_flush                     uint32
 	nodelay, updated                       uint32
 	ts_probe, probe_wait                   uint32
-	dead_link, incr                        uint32
+	dead_link                              uint32
 
 	fastresend     int32
 	nocwnd, stream int32
+	cc             CongestionController
+	rate_wnd       uint32 // window allowed by the send rate limit, 0 for none
+
+	// transmissions & retransmissions since last sampled by the session
+	xmitSegs, retransSegs uint32
+
+	// path mtu probing
+	pmtuAcks  []uint32 // sizes of the probes received, to be acknowledged
+	pmtuAcked uint32   // size of the latest probe acknowledged by remote
+
+	// accumulated counters of this connection
+	inSegs, outSegs, lostSegs, fastRetransSegs, repeatSegs uint64
 
-	snd_queue []segment
-	rcv_queue []segment
-	snd_buf   []segment
-	rcv_buf   []segment
+	snd_queue segmentQueue
+	rcv_queue segmentQueue
+	snd_buf   segmentQueue  // the segments of consecutive sn from snd_una
+	rcv_buf   segmentWindow // the segments received out of order, indexed by sn
+
+	// orderly shutdown, the FIN has been received in sequence
+	rcv_fin bool
+
+	// unreliable datagrams, sent once and delivered as they arrive
+	snd_dgrams     segmentQueue
+	rcv_dgrams     segmentQueue
+	dgram_inflight []uint32 // the ts until which each datagram sent counts as inflight
 
 	acklist []ackItem
 
 	buffer []byte
 	output output_callback
+	clock  Clock
 }
 
 type ackItem struct {
@@ -159,6 +196,7 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.conv = conv
 	kcp.snd_wnd = IKCP_WND_SND
 	kcp.rcv_wnd = IKCP_WND_RCV
+	kcp.rcv_buf.reserve(kcp.rcv_wnd)
 	kcp.rmt_wnd = IKCP_WND_RCV
 	kcp.mtu = IKCP_MTU_DEF
 	kcp.mss = kcp.mtu - IKCP_OVERHEAD
@@ -167,9 +205,10 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.rx_minrto = IKCP_RTO_MIN
 	kcp.interval = IKCP_INTERVAL
 	kcp.ts_flush = IKCP_INTERVAL
-	kcp.ssthresh = IKCP_THRESH_INIT
 	kcp.dead_link = IKCP_DEADLINK
+	kcp.cc = NewRenoController()
 	kcp.output = output
+	kcp.clock = SystemClock
 	return kcp
 }
 
@@ -189,21 +228,21 @@ func (kcp *KCP) delSegment(seg *segment) {
 
 // PeekSize checks the size of next message in the recv queue
 func (kcp *KCP) PeekSize() (length int) {
-	if len(kcp.rcv_queue) == 0 {
+	if kcp.rcv_queue.Len() == 0 {
 		return -1
 	}
 
-	seg := &kcp.rcv_queue[0]
+	seg := kcp.rcv_queue.front()
 	if seg.frg == 0 {
 		return len(seg.data)
 	}
 
-	if len(kcp.rcv_queue) < int(seg.frg+1) {
+	if kcp.rcv_queue.Len() < int(seg.frg+1) {
 		return -1
 	}
 
-	for k := range kcp.rcv_queue {
-		seg := &kcp.rcv_queue[k]
+	for k := 0; k < kcp.rcv_queue.Len(); k++ {
+		seg := kcp.rcv_queue.at(k)
 		length += len(seg.data)
 		if seg.frg == 0 {
 			break
@@ -214,7 +253,7 @@ func (kcp *KCP) PeekSize() (length int) {
 
 // Recv is user/upper level recv: returns size, returns below zero for EAGAIN
 func (kcp *KCP) Recv(buffer []byte) (n int) {
-	if len(kcp.rcv_queue) == 0 {
+	if kcp.rcv_queue.Len() == 0 {
 		return -1
 	}
 
@@ -228,14 +267,14 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	var fast_recover bool
-	if len(kcp.rcv_queue) >= int(kcp.rcv_wnd) {
+	if kcp.rcv_queue.Len() >= int(kcp.rcv_wnd) {
 		fast_recover = true
 	}
 
 	// merge fragment
 	count := 0
-	for k := range kcp.rcv_queue {
-		seg := &kcp.rcv_queue[k]
+	for k := 0; k < kcp.rcv_queue.Len(); k++ {
+		seg := kcp.rcv_queue.at(k)
 		copy(buffer, seg.data)
 		buffer = buffer[len(seg.data):]
 		n += len(seg.data)
@@ -245,29 +284,13 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 			break
 		}
 	}
-	if count > 0 {
-		kcp.rcv_queue = kcp.remove_front(kcp.rcv_queue, count)
-	}
+	kcp.rcv_queue.pop(count)
 
 	// move available data from rcv_buf -> rcv_queue
-	count = 0
-	for k := range kcp.rcv_buf {
-		seg := &kcp.rcv_buf[k]
-		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
-			kcp.rcv_nxt++
-			count++
-		} else {
-			break
-		}
-	}
-
-	if count > 0 {
-		kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[:count]...)
-		kcp.rcv_buf = kcp.remove_front(kcp.rcv_buf, count)
-	}
+	kcp.move_rcv_buf()
 
 	// fast recover
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) && fast_recover {
+	if kcp.rcv_queue.Len() < int(kcp.rcv_wnd) && fast_recover {
 		// ready to send back IKCP_CMD_WINS in ikcp_flush
 		// tell remote my window size
 		kcp.probe |= IKCP_ASK_TELL
@@ -284,9 +307,8 @@ func (kcp *KCP) Send(buffer []byte) int {
 
 	// append to previous segment in streaming mode (if possible)
 	if kcp.stream != 0 {
-		n := len(kcp.snd_queue)
-		if n > 0 {
-			seg := &kcp.snd_queue[n-1]
+		if kcp.snd_queue.Len() > 0 {
+			seg := kcp.snd_queue.back()
 			if len(seg.data) < int(kcp.mss) {
 				capacity := int(kcp.mss) - len(seg.data)
 				extend := capacity
@@ -314,7 +336,7 @@ func (kcp *KCP) Send(buffer []byte) int {
 		count = (len(buffer) + int(kcp.mss) - 1) / int(kcp.mss)
 	}
 
-	if count > 255 {
+	if count > maxFragments {
 		return -2
 	}
 
@@ -336,12 +358,88 @@ func (kcp *KCP) Send(buffer []byte) int {
 		} else { // stream mode
 			seg.frg = 0
 		}
-		kcp.snd_queue = append(kcp.snd_queue, seg)
+		kcp.snd_queue.push(seg)
 		buffer = buffer[size:]
 	}
 	return 0
 }
 
+// SendFin queues a FIN after the data sent so far, it's delivered reliably
+// and in sequence like the data, no data is to be sent after it
+func (kcp *KCP) SendFin() {
+	seg := kcp.newSegment(0)
+	seg.cmd = IKCP_CMD_FIN
+	kcp.snd_queue.push(seg)
+}
+
+// FinReceived checks if the remote has sent a FIN, and all the data before
+// it has been received
+func (kcp *KCP) FinReceived() bool {
+	return kcp.rcv_fin && kcp.rcv_queue.Len() == 0
+}
+
+// SendDatagram queues an unreliable datagram to be sent at the next flush,
+// in the room left in the congestion window, where it counts as inflight for
+// an RTT once sent. The oldest datagram is dropped
+// when snd_wnd datagrams are already queued. It returns below zero for an
+// empty datagram, or one larger than mss.
+func (kcp *KCP) SendDatagram(buffer []byte) int {
+	if len(buffer) == 0 {
+		return -1
+	}
+	if len(buffer) > int(kcp.mss) {
+		return -2
+	}
+	if kcp.snd_dgrams.Len() >= int(kcp.snd_wnd) {
+		kcp.delSegment(kcp.snd_dgrams.front())
+		kcp.snd_dgrams.pop(1)
+	}
+	seg := kcp.newSegment(len(buffer))
+	copy(seg.data, buffer)
+	kcp.snd_dgrams.push(seg)
+	return 0
+}
+
+// expire_dgrams stops counting the datagrams sent an RTT ago as inflight
+func (kcp *KCP) expire_dgrams(current uint32) {
+	n := 0
+	for n < len(kcp.dgram_inflight) && _itimediff(current, kcp.dgram_inflight[n]) >= 0 {
+		n++
+	}
+	kcp.dgram_inflight = kcp.dgram_inflight[n:]
+}
+
+// RecvDatagram receives a datagram, returns its size, or below zero if
+// there's none, or if it's larger than 'buffer'
+func (kcp *KCP) RecvDatagram(buffer []byte) (n int) {
+	if kcp.rcv_dgrams.Len() == 0 {
+		return -1
+	}
+	seg := kcp.rcv_dgrams.front()
+	if len(seg.data) > len(buffer) {
+		return -3
+	}
+	n = copy(buffer, seg.data)
+	kcp.delSegment(seg)
+	kcp.rcv_dgrams.pop(1)
+	return
+}
+
+// parse_dgram queues a datagram received, the oldest datagram is dropped
+// when rcv_wnd datagrams are waiting to be received
+func (kcp *KCP) parse_dgram(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if kcp.rcv_dgrams.Len() >= int(kcp.rcv_wnd) {
+		kcp.delSegment(kcp.rcv_dgrams.front())
+		kcp.rcv_dgrams.pop(1)
+	}
+	seg := kcp.newSegment(len(data))
+	copy(seg.data, data)
+	kcp.rcv_dgrams.push(seg)
+}
+
 func (kcp *KCP) update_ack(rtt int32) {
 	// https://tools.ietf.org/html/rfc6298
 	var rto uint32
@@ -368,8 +466,8 @@ func (kcp *KCP) update_ack(rtt int32) {
 }
 
 func (kcp *KCP) shrink_buf() {
-	if len(kcp.snd_buf) > 0 {
-		seg := &kcp.snd_buf[0]
+	if kcp.snd_buf.Len() > 0 {
+		seg := kcp.snd_buf.front()
 		kcp.snd_una = seg.sn
 	} else {
 		kcp.snd_una = kcp.snd_nxt
@@ -381,16 +479,11 @@ func (kcp *KCP) parse_ack(sn uint32) {
 		return
 	}
 
-	for k := range kcp.snd_buf {
-		seg := &kcp.snd_buf[k]
-		if sn == seg.sn {
-			seg.acked = 1
-			kcp.delSegment(seg)
-			break
-		}
-		if _itimediff(sn, seg.sn) < 0 {
-			break
-		}
+	// sn is in snd_buf, which holds consecutive sn
+	seg := kcp.snd_buf.at(int(sn - kcp.snd_buf.front().sn))
+	if seg.sn == sn {
+		seg.acked = 1
+		kcp.delSegment(seg)
 	}
 }
 
@@ -399,11 +492,11 @@ func (kcp *KCP) parse_fastack(sn, ts uint32) {
 		return
 	}
 
-	for k := range kcp.snd_buf {
-		seg := &kcp.snd_buf[k]
-		if _itimediff(sn, seg.sn) < 0 {
+	for k := 0; k < kcp.snd_buf.Len(); k++ {
+		seg := kcp.snd_buf.at(k)
+		if _itimediff(sn, seg.sn) <= 0 {
 			break
-		} else if sn != seg.sn && _itimediff(seg.ts, ts) <= 0 {
+		} else if _itimediff(seg.ts, ts) <= 0 {
 			seg.fastack++
 		}
 	}
@@ -411,8 +504,8 @@ func (kcp *KCP) parse_fastack(sn, ts uint32) {
 
 func (kcp *KCP) parse_una(una uint32) {
 	count := 0
-	for k := range kcp.snd_buf {
-		seg := &kcp.snd_buf[k]
+	for count < kcp.snd_buf.Len() {
+		seg := kcp.snd_buf.at(count)
 		if _itimediff(una, seg.sn) > 0 {
 			kcp.delSegment(seg)
 			count++
@@ -420,9 +513,7 @@ func (kcp *KCP) parse_una(una uint32) {
 			break
 		}
 	}
-	if count > 0 {
-		kcp.snd_buf = kcp.remove_front(kcp.snd_buf, count)
-	}
+	kcp.snd_buf.pop(count)
 }
 
 // ack append
@@ -438,53 +529,37 @@ func (kcp *KCP) parse_data(newseg segment) bool {
 		return true
 	}
 
-	n := len(kcp.rcv_buf) - 1
-	insert_idx := 0
-	repeat := false
-	for i := n; i >= 0; i-- {
-		seg := &kcp.rcv_buf[i]
-		if seg.sn == sn {
-			repeat = true
-			break
-		}
-		if _itimediff(sn, seg.sn) > 0 {
-			insert_idx = i + 1
-			break
-		}
+	if kcp.rcv_buf.get(sn) != nil {
+		return true
 	}
 
-	if !repeat {
-		// replicate the content if it's new
-		dataCopy := xmitBuf.Get().([]byte)[:len(newseg.data)]
-		copy(dataCopy, newseg.data)
-		newseg.data = dataCopy
-
-		if insert_idx == n+1 {
-			kcp.rcv_buf = append(kcp.rcv_buf, newseg)
-		} else {
-			kcp.rcv_buf = append(kcp.rcv_buf, segment{})
-			copy(kcp.rcv_buf[insert_idx+1:], kcp.rcv_buf[insert_idx:])
-			kcp.rcv_buf[insert_idx] = newseg
-		}
-	}
+	// replicate the content if it's new
+	dataCopy := xmitBuf.Get().([]byte)[:len(newseg.data)]
+	copy(dataCopy, newseg.data)
+	newseg.data = dataCopy
+	kcp.rcv_buf.put(newseg)
 
 	// move available data from rcv_buf -> rcv_queue
-	count := 0
-	for k := range kcp.rcv_buf {
-		seg := &kcp.rcv_buf[k]
-		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
-			kcp.rcv_nxt++
-			count++
-		} else {
+	kcp.move_rcv_buf()
+	return false
+}
+
+// move_rcv_buf moves the segments in order from rcv_buf to rcv_queue,
+// as long as the receive window allows
+func (kcp *KCP) move_rcv_buf() {
+	for kcp.rcv_queue.Len() < int(kcp.rcv_wnd) {
+		seg, ok := kcp.rcv_buf.take(kcp.rcv_nxt)
+		if !ok {
 			break
 		}
+		kcp.rcv_nxt++
+		if seg.cmd == IKCP_CMD_FIN {
+			kcp.delSegment(&seg)
+			kcp.rcv_fin = true
+			continue
+		}
+		kcp.rcv_queue.push(seg)
 	}
-	if count > 0 {
-		kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[:count]...)
-		kcp.rcv_buf = kcp.remove_front(kcp.rcv_buf, count)
-	}
-
-	return repeat
 }
 
 // Input when you received a low level packet (eg. UDP packet), call it
@@ -495,7 +570,8 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		return -1
 	}
 
-	var latest uint32 // the latest ack packet
+	var latest uint32 // the ts of the largest ack
+	var maxack uint32 // the largest sn acknowledged
 	var flag int
 	var inSegs uint64
 
@@ -525,7 +601,10 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		}
 
 		if cmd != IKCP_CMD_PUSH && cmd != IKCP_CMD_ACK &&
-			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS {
+			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS &&
+			cmd != IKCP_CMD_PMTU && cmd != IKCP_CMD_PMTU_OK &&
+			cmd != IKCP_CMD_ALIVE && cmd != IKCP_CMD_DGRAM &&
+			cmd != IKCP_CMD_FIN {
 			return -3
 		}
 
@@ -538,12 +617,15 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 
 		if cmd == IKCP_CMD_ACK {
 			kcp.parse_ack(sn)
-			kcp.parse_fastack(sn, ts)
+			if flag == 0 || _itimediff(sn, maxack) > 0 {
+				maxack = sn
+				latest = ts
+			}
 			flag |= 1
-			latest = ts
-		} else if cmd == IKCP_CMD_PUSH {
+		} else if cmd == IKCP_CMD_PUSH || cmd == IKCP_CMD_FIN {
 			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 {
 				kcp.ack_push(sn, ts)
+				repeat := true
 				if _itimediff(sn, kcp.rcv_nxt) >= 0 {
 					var seg segment
 					seg.conv = conv
@@ -554,7 +636,11 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 					seg.sn = sn
 					seg.una = una
 					seg.data = data[:length] // delayed data copying
-					kcp.parse_data(seg)
+					repeat = kcp.parse_data(seg)
+				}
+				if regular && repeat {
+					kcp.repeatSegs++
+					atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
 				}
 			}
 		} else if cmd == IKCP_CMD_WASK {
@@ -563,6 +649,15 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 			kcp.probe |= IKCP_ASK_TELL
 		} else if cmd == IKCP_CMD_WINS {
 			// do nothing
+		} else if cmd == IKCP_CMD_PMTU {
+			// the probe has got through, the padding is ignored
+			kcp.pmtuAcks = append(kcp.pmtuAcks, sn)
+		} else if cmd == IKCP_CMD_PMTU_OK {
+			kcp.pmtuAcked = sn
+		} else if cmd == IKCP_CMD_ALIVE {
+			// do nothing
+		} else if cmd == IKCP_CMD_DGRAM {
+			kcp.parse_dgram(data[:length])
 		} else {
 			return -3
 		}
@@ -570,55 +665,48 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		inSegs++
 		data = data[length:]
 	}
+	kcp.inSegs += inSegs
+	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
+
+	// the segments before the largest ack are skipped once per packet
+	if flag != 0 {
+		kcp.parse_fastack(maxack, latest)
+	}
 
 	// update rtt with the latest ts
+	rtt := int32(-1)
 	if flag != 0 && regular {
-		current := currentMs()
+		current := currentMs(kcp.clock)
 		if _itimediff(current, latest) >= 0 {
-			kcp.update_ack(_itimediff(current, latest))
+			rtt = _itimediff(current, latest)
+			kcp.update_ack(rtt)
 		}
 	}
 
 	// cwnd update when packet arrived
 	if kcp.nocwnd == 0 {
 		if _itimediff(kcp.snd_una, snd_una) > 0 {
-			if kcp.cwnd < kcp.rmt_wnd {
-				mss := kcp.mss
-				if kcp.cwnd < kcp.ssthresh {
-					kcp.cwnd++
-					kcp.incr += mss
-				} else {
-					if kcp.incr < mss {
-						kcp.incr = mss
-					}
-					kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
-					if (kcp.cwnd+1)*mss <= kcp.incr {
-						kcp.cwnd++
-					}
-				}
-				if kcp.cwnd > kcp.rmt_wnd {
-					kcp.cwnd = kcp.rmt_wnd
-					kcp.incr = kcp.rmt_wnd * mss
-				}
-			}
+			info := kcp.congestionInfo()
+			kcp.cc.OnAck(&info, kcp.snd_una-snd_una, rtt)
 		}
 	}
 
-	if ackNoDelay && len(kcp.acklist) > 0 { // ack immediately
+	if ackNoDelay && len(kcp.acklist) > 0 || len(kcp.pmtuAcks) > 0 { // ack immediately
 		kcp.flush(true)
 	}
 	return 0
 }
 
 func (kcp *KCP) wnd_unused() uint16 {
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
-		return uint16(int(kcp.rcv_wnd) - len(kcp.rcv_queue))
+	if kcp.rcv_queue.Len() < int(kcp.rcv_wnd) {
+		return uint16(int(kcp.rcv_wnd) - kcp.rcv_queue.Len())
 	}
 	return 0
 }
 
 // flush pending data
 func (kcp *KCP) flush(ackOnly bool) uint32 {
+	var outSegs uint64
 	var seg segment
 	seg.conv = kcp.conv
 	seg.cmd = IKCP_CMD_ACK
@@ -638,21 +726,37 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		if ack.sn >= kcp.rcv_nxt || len(kcp.acklist)-1 == i {
 			seg.sn, seg.ts = ack.sn, ack.ts
 			ptr = seg.encode(ptr)
+			outSegs++
 		}
 	}
 	kcp.acklist = kcp.acklist[0:0]
 
+	// acknowledge path mtu probes, with the probe size in sn
+	seg.cmd = IKCP_CMD_PMTU_OK
+	for _, size := range kcp.pmtuAcks {
+		if len(buffer)-len(ptr)+IKCP_OVERHEAD > int(kcp.mtu) {
+			kcp.output(buffer, len(buffer)-len(ptr))
+			ptr = buffer
+		}
+		seg.sn, seg.ts = size, 0
+		ptr = seg.encode(ptr)
+		outSegs++
+	}
+	kcp.pmtuAcks = kcp.pmtuAcks[0:0]
+
 	if ackOnly { // flash remain ack segments
 		size := len(buffer) - len(ptr)
 		if size > 0 {
 			kcp.output(buffer, size)
 		}
+		kcp.outSegs += outSegs
+		atomic.AddUint64(&DefaultSnmp.OutSegs, outSegs)
 		return kcp.interval
 	}
 
 	// probe window size (if remote window size equals zero)
 	if kcp.rmt_wnd == 0 {
-		current := currentMs()
+		current := currentMs(kcp.clock)
 		if kcp.probe_wait == 0 {
 			kcp.probe_wait = IKCP_PROBE_INIT
 			kcp.ts_probe = current + kcp.probe_wait
@@ -683,6 +787,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			ptr = buffer
 		}
 		ptr = seg.encode(ptr)
+		outSegs++
 	}
 
 	// flush window probing commands
@@ -694,33 +799,95 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			ptr = buffer
 		}
 		ptr = seg.encode(ptr)
+		outSegs++
+	}
+
+	// flush keepalive
+	if (kcp.probe & IKCP_ASK_ALIVE) != 0 {
+		seg.cmd = IKCP_CMD_ALIVE
+		size := len(buffer) - len(ptr)
+		if size+IKCP_OVERHEAD > int(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
+		}
+		ptr = seg.encode(ptr)
+		outSegs++
 	}
 
 	kcp.probe = 0
 
+	// the datagrams sent an RTT ago are no longer inflight
+	current := currentMs(kcp.clock)
+	kcp.expire_dgrams(current)
+
 	// calculate window size
 	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
 	if kcp.nocwnd == 0 {
+		info := kcp.congestionInfo()
+		kcp.cwnd = kcp.cc.OnFlush(&info)
 		cwnd = _imin_(kcp.cwnd, cwnd)
 	}
+	if kcp.rate_wnd > 0 {
+		cwnd = _imin_(kcp.rate_wnd, cwnd)
+	}
+
+	// datagrams take the room left in the window first, as they are sent once
+	// they are limited by the congestion window only, not the remote window.
+	// They count as inflight for an RTT, when they would have been acknowledged.
+	inflight := uint32(len(kcp.dgram_inflight))
+	dgramWnd := kcp.snd_wnd
+	if kcp.nocwnd == 0 {
+		dgramWnd = _imin_(kcp.cwnd, dgramWnd)
+	}
+	if kcp.rate_wnd > 0 {
+		dgramWnd = _imin_(kcp.rate_wnd, dgramWnd)
+	}
+	dgrams := 0
+	for dgrams < kcp.snd_dgrams.Len() && _itimediff(kcp.snd_nxt+inflight+uint32(dgrams), kcp.snd_una+dgramWnd) < 0 {
+		dgram := kcp.snd_dgrams.at(dgrams)
+		dgram.conv = kcp.conv
+		dgram.cmd = IKCP_CMD_DGRAM
+		dgram.wnd = seg.wnd
+		dgram.una = seg.una
+		size := len(buffer) - len(ptr)
+		if size+IKCP_OVERHEAD+len(dgram.data) > int(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
+		}
+		ptr = dgram.encode(ptr)
+		copy(ptr, dgram.data)
+		ptr = ptr[len(dgram.data):]
+		kcp.delSegment(dgram)
+		outSegs++
+		dgrams++
+	}
+	kcp.snd_dgrams.pop(dgrams)
+	hold := kcp.rx_srtt
+	if hold <= 0 {
+		hold = int32(kcp.rx_rto)
+	}
+	for k := 0; k < dgrams; k++ {
+		kcp.dgram_inflight = append(kcp.dgram_inflight, current+uint32(hold))
+	}
+	inflight += uint32(dgrams)
 
 	// sliding window, controlled by snd_nxt && sna_una+cwnd
 	newSegsCount := 0
-	for k := range kcp.snd_queue {
-		if _itimediff(kcp.snd_nxt, kcp.snd_una+cwnd) >= 0 {
+	for newSegsCount < kcp.snd_queue.Len() {
+		if _itimediff(kcp.snd_nxt+inflight, kcp.snd_una+cwnd) >= 0 {
 			break
 		}
-		newseg := kcp.snd_queue[k]
+		newseg := *kcp.snd_queue.at(newSegsCount)
 		newseg.conv = kcp.conv
-		newseg.cmd = IKCP_CMD_PUSH
+		if newseg.cmd != IKCP_CMD_FIN {
+			newseg.cmd = IKCP_CMD_PUSH
+		}
 		newseg.sn = kcp.snd_nxt
-		kcp.snd_buf = append(kcp.snd_buf, newseg)
+		kcp.snd_buf.push(newseg)
 		kcp.snd_nxt++
 		newSegsCount++
 	}
-	if newSegsCount > 0 {
-		kcp.snd_queue = kcp.remove_front(kcp.snd_queue, newSegsCount)
-	}
+	kcp.snd_queue.pop(newSegsCount)
 
 	// calculate resent
 	resent := uint32(kcp.fastresend)
@@ -729,13 +896,12 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	}
 
 	// check for retransmissions
-	current := currentMs()
+	current = currentMs(kcp.clock)
 	var change, lost, fastRetransSegs, earlyRetransSegs uint64
 	minrto := int32(kcp.interval)
 
-	ref := kcp.snd_buf[:len(kcp.snd_buf)] // for bounds check elimination
-	for k := range ref {
-		segment := &ref[k]
+	for k := 0; k < kcp.snd_buf.Len(); k++ {
+		segment := kcp.snd_buf.at(k)
 		needsend := false
 		if segment.acked == 1 {
 			continue
@@ -770,8 +936,9 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 
 		if needsend {
-			current = currentMs() // time update for a blocking call
+			current = currentMs(kcp.clock) // time update for a blocking call
 			segment.xmit++
+			kcp.xmitSegs++
 			segment.ts = current
 			segment.wnd = seg.wnd
 			segment.una = seg.una
@@ -787,6 +954,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			ptr = segment.encode(ptr)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
+			outSegs++
 
 			if segment.xmit >= kcp.dead_link {
 				kcp.state = 0xFFFFFFFF
@@ -804,47 +972,60 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	if size > 0 {
 		kcp.output(buffer, size)
 	}
+	kcp.retransSegs += uint32(lost + change)
+	kcp.lostSegs += lost
+	kcp.fastRetransSegs += fastRetransSegs + earlyRetransSegs
+	kcp.outSegs += outSegs
 
-	// cwnd update
-	if kcp.nocwnd == 0 {
-		// update ssthresh
-		// rate halving, https://tools.ietf.org/html/rfc6937
-		if change > 0 {
-			inflight := kcp.snd_nxt - kcp.snd_una
-			kcp.ssthresh = inflight / 2
-			if kcp.ssthresh < IKCP_THRESH_MIN {
-				kcp.ssthresh = IKCP_THRESH_MIN
-			}
-			kcp.cwnd = kcp.ssthresh + resent
-			kcp.incr = kcp.cwnd * kcp.mss
-		}
-
-		// congestion control, https://tools.ietf.org/html/rfc5681
-		if lost > 0 {
-			kcp.ssthresh = cwnd / 2
-			if kcp.ssthresh < IKCP_THRESH_MIN {
-				kcp.ssthresh = IKCP_THRESH_MIN
-			}
-			kcp.cwnd = 1
-			kcp.incr = kcp.mss
-		}
+	// counter updates
+	sum := lost
+	if lost > 0 {
+		atomic.AddUint64(&DefaultSnmp.LostSegs, lost)
+	}
+	if fastRetransSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.FastRetransSegs, fastRetransSegs)
+		sum += fastRetransSegs
+	}
+	if earlyRetransSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
+		sum += earlyRetransSegs
+	}
+	if sum > 0 {
+		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
+	}
+	atomic.AddUint64(&DefaultSnmp.OutSegs, outSegs)
 
-		if kcp.cwnd < 1 {
-			kcp.cwnd = 1
-			kcp.incr = kcp.mss
-		}
+	// cwnd update
+	if kcp.nocwnd == 0 && (lost > 0 || change > 0) {
+		info := kcp.congestionInfo()
+		kcp.cc.OnLoss(&info, uint32(lost), uint32(change))
 	}
 
 	return uint32(minrto)
 }
 
+// congestionInfo takes a snapshot of the states for the congestion controller
+func (kcp *KCP) congestionInfo() (info CongestionInfo) {
+	info.Current = currentMs(kcp.clock)
+	info.Mss = kcp.mss
+	info.Inflight = kcp.snd_nxt - kcp.snd_una + uint32(len(kcp.dgram_inflight))
+	info.SndWnd = kcp.snd_wnd
+	info.RmtWnd = kcp.rmt_wnd
+	if kcp.fastresend > 0 {
+		info.FastResend = uint32(kcp.fastresend)
+	}
+	info.Srtt = kcp.rx_srtt
+	info.Interval = kcp.interval
+	return
+}
+
 // Update updates state (call it repeatedly, every 10ms-100ms), or you can ask
 // ikcp_check when to call it again (without ikcp_input/_send calling).
 // 'current' - current timestamp in millisec.
 func (kcp *KCP) Update() {
 	var slap int32
 
-	current := currentMs()
+	current := currentMs(kcp.clock)
 	if kcp.updated == 0 {
 		kcp.updated = 1
 		kcp.ts_flush = current
@@ -874,7 +1055,7 @@ func (kcp *KCP) Update() {
 // schedule ikcp_update (eg. implementing an epoll-like mechanism,
 // or optimize ikcp_update when handling massive kcp connections)
 func (kcp *KCP) Check() uint32 {
-	current := currentMs()
+	current := currentMs(kcp.clock)
 	ts_flush := kcp.ts_flush
 	tm_flush := int32(0x7fffffff)
 	tm_packet := int32(0x7fffffff)
@@ -894,8 +1075,8 @@ func (kcp *KCP) Check() uint32 {
 
 	tm_flush = _itimediff(ts_flush, current)
 
-	for k := range kcp.snd_buf {
-		seg := &kcp.snd_buf[k]
+	for k := 0; k < kcp.snd_buf.Len(); k++ {
+		seg := kcp.snd_buf.at(k)
 		diff := _itimediff(seg.resendts, current)
 		if diff <= 0 {
 			return current
@@ -916,6 +1097,12 @@ func (kcp *KCP) Check() uint32 {
 	return current + minimal
 }
 
+// SetClock changes the time source of the timers, default is SystemClock,
+// it should be set before the first Update.
+func (kcp *KCP) SetClock(clock Clock) {
+	kcp.clock = clock
+}
+
 // SetMtu changes MTU size, default is 1400
 func (kcp *KCP) SetMtu(mtu int) int {
 	if mtu < 50 || mtu < IKCP_OVERHEAD {
@@ -931,6 +1118,19 @@ func (kcp *KCP) SetMtu(mtu int) int {
 	return 0
 }
 
+// encodePmtuProbe fills 'buf' with a path mtu probe segment padded to the
+// end of 'buf', the sn field carries the probe size to be acknowledged
+func (kcp *KCP) encodePmtuProbe(buf []byte, size uint32) {
+	var seg segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_PMTU
+	seg.wnd = kcp.wnd_unused()
+	seg.una = kcp.rcv_nxt
+	seg.sn = size
+	seg.data = buf[IKCP_OVERHEAD:]
+	seg.encode(buf)
+}
+
 // NoDelay options
 // fastest: ikcp_nodelay(kcp, 1, 20, 2, 1)
 // nodelay: 0:disable(default), 1:enable
@@ -970,17 +1170,21 @@ func (kcp *KCP) WndSize(sndwnd, rcvwnd int) int {
 	}
 	if rcvwnd > 0 {
 		kcp.rcv_wnd = uint32(rcvwnd)
+		kcp.rcv_buf.reserve(kcp.rcv_wnd)
 	}
 	return 0
 }
 
 // WaitSnd gets how many packet is waiting to be sent
 func (kcp *KCP) WaitSnd() int {
-	return len(kcp.snd_buf) + len(kcp.snd_queue)
+	return kcp.snd_buf.Len() + kcp.snd_queue.Len()
 }
 
-// remove front n elements from queue
-func (kcp *KCP) remove_front(q []segment, n int) []segment {
-	newn := copy(q, q[n:])
-	return q[:newn]
+// idle checks if there's nothing to send, retransmit, acknowledge or probe,
+// so that flush has nothing to do until the next Send or Input
+func (kcp *KCP) idle() bool {
+	return kcp.snd_queue.Len() == 0 && kcp.snd_buf.Len() == 0 &&
+		kcp.snd_dgrams.Len() == 0 &&
+		len(kcp.acklist) == 0 && len(kcp.pmtuAcks) == 0 &&
+		kcp.probe == 0 && kcp.rmt_wnd != 0
 }
@@ -0,0 +1,91 @@
+package kcp
+
+import (
+	"testing"
+	"time"
+)
+
+// ackPacket encodes the acks of 'sns' sent at 'ts' in one packet
+func ackPacket(conv uint32, ts []uint32, sns ...uint32) []byte {
+	var buf []byte
+	for i, sn := range sns {
+		seg := segment{conv: conv, cmd: IKCP_CMD_ACK, wnd: IKCP_WND_RCV, ts: ts[i], sn: sn}
+		b := make([]byte, IKCP_OVERHEAD)
+		seg.encode(b)
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+// sentKCP returns a KCP with 'n' segments in flight, one sent every 'gap'
+func sentKCP(clock *ManualClock, n int, gap time.Duration) (*KCP, []uint32) {
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.SetClock(clock)
+	kcp.NoDelay(1, 10, 0, 1)
+	var ts []uint32
+	for i := 0; i < n; i++ {
+		kcp.Send([]byte{byte(i)})
+		ts = append(ts, currentMs(clock))
+		kcp.flush(false)
+		clock.Advance(gap)
+	}
+	return kcp, ts
+}
+
+func TestInputFastack(t *testing.T) {
+	kcp, ts := sentKCP(NewManualClock(time.Now()), 5, 0)
+
+	// 0 and 1 are skipped by the acks of 2, 3 and 4 in the same packet
+	kcp.Input(ackPacket(1, []uint32{ts[4], ts[2], ts[3]}, 4, 2, 3), true, false)
+	for k := 0; k < kcp.snd_buf.Len(); k++ {
+		if seg := kcp.snd_buf.at(k); seg.acked == 0 && seg.fastack != 1 {
+			t.Fatalf("sn %v skipped %v times, want 1", seg.sn, seg.fastack)
+		}
+	}
+}
+
+func TestInputRTT(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	kcp, ts := sentKCP(clock, 2, 100*time.Millisecond)
+
+	// the ack of 1 is the latest sample, wherever it is in the packet
+	kcp.Input(ackPacket(1, []uint32{ts[1], ts[0]}, 1, 0), true, false)
+	if kcp.rx_srtt != 100 {
+		t.Fatalf("srtt %v, want 100", kcp.rx_srtt)
+	}
+}
+
+func TestDatagramInflight(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.SetClock(clock)
+	kcp.NoDelay(1, 10, 0, 1)
+	kcp.WndSize(8, IKCP_WND_RCV)
+	send := func() {
+		for i := 0; i < 8; i++ {
+			kcp.SendDatagram([]byte{byte(i)})
+		}
+	}
+
+	send()
+	kcp.flush(false)
+	if n := kcp.snd_dgrams.Len(); n != 0 {
+		t.Fatalf("%v datagrams held, want 0", n)
+	}
+	if info := kcp.congestionInfo(); info.Inflight != 8 {
+		t.Fatalf("inflight %v, want 8", info.Inflight)
+	}
+
+	// the window is taken until an RTT has passed
+	send()
+	kcp.Send([]byte{1})
+	kcp.flush(false)
+	if n := kcp.snd_dgrams.Len(); n != 8 || kcp.snd_nxt != 0 {
+		t.Fatalf("%v datagrams held, snd_nxt %v, want 8 and 0", n, kcp.snd_nxt)
+	}
+	clock.Advance(time.Duration(kcp.rx_rto) * time.Millisecond)
+	kcp.flush(false)
+	if n := kcp.snd_dgrams.Len(); n != 0 {
+		t.Fatalf("%v datagrams held after an RTT, want 0", n)
+	}
+}
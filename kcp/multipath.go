@@ -0,0 +1,601 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the paths are probed at this interval
+	multipathProbeInterval = 500 * time.Millisecond
+
+	// a path is down after this many probes unanswered in a row
+	multipathProbeLosses = 2
+
+	// the payload of a probe: the path index, the probe sequence and the
+	// time it was sent
+	multipathProbeSize = 16
+
+	// the packets up to this size are sent on every path whatever the
+	// scheduling, the handshake, the acknowledgments and the keepalives are
+	// small and worth the redundancy
+	multipathSmallPacket = 128
+
+	// the packets read from the paths and not returned by ReadFrom yet
+	multipathBacklog = 1024
+)
+
+var errNoPath = errors.New("no path")
+
+// MultipathMode is how a MultipathConn schedules the packets over its paths
+type MultipathMode int
+
+const (
+	// MultipathWeighted sends each packet on one path, in a smooth weighted
+	// round robin of the paths up. A path is weighted by the inverse of its
+	// round trip time and the square of its delivery rate.
+	MultipathWeighted MultipathMode = iota
+	// MultipathRedundant sends each packet on every path up, the duplicates
+	// are discarded by the receiver.
+	MultipathRedundant
+)
+
+// PathStats describes a path of a MultipathConn
+type PathStats struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	RTT        time.Duration // the smoothed round trip time of the probes, 0 before the first answer
+	Loss       float64       // the smoothed loss rate of the probes
+	Up         bool          // the path is used by the scheduler
+	TxPackets  uint64
+	RxPackets  uint64
+}
+
+// multipathPath is a packet connection and the remote address it sends to
+type multipathPath struct {
+	txPackets uint64 // atomic
+	rxPackets uint64 // atomic
+
+	conn   net.PacketConn
+	remote net.Addr
+	index  uint32
+
+	// guarded by MultipathConn.mu
+	srtt     time.Duration
+	loss     float64
+	probeSeq uint32
+	probing  bool    // the last probe is unanswered
+	losses   int     // the probes unanswered in a row
+	writeErr bool    // the last write has failed
+	failed   bool    // the path can't be read anymore
+	current  float64 // the state of the smooth weighted round robin
+}
+
+// up reports whether the scheduler may use the path
+func (p *multipathPath) up() bool {
+	return !p.failed && !p.writeErr && p.losses < multipathProbeLosses
+}
+
+// weight is the share of the packets the path deserves, 0 before it's
+// measured
+func (p *multipathPath) weight() float64 {
+	if p.srtt == 0 {
+		return 0
+	}
+	delivery := 1 - p.loss
+	return delivery * delivery / p.srtt.Seconds()
+}
+
+type multipathPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// MultipathConn is a packet connection spreading the packets of a session
+// over several paths, each one a packet connection and the address of the
+// server on it: UDP sockets bound to different uplinks, tcpraw connections,
+// or a mix. It's given to NewConn in place of a single connection.
+//
+// Once the session is established, every path is probed to score its round
+// trip time and loss rate, the server echoes the probes of the conv of a
+// session on the path they came from. The packets are
+// scheduled over the paths up according to the MultipathMode, a path whose
+// probes go unanswered or whose writes fail is left out until it answers
+// again, so a failing path doesn't interrupt the session. The server answers
+// over the path the latest packets came from, which it only follows for a
+// session encrypted by a real cipher, not crypt none.
+//
+// The probes are encrypted as the packets of the session, so the block and
+// the FEC shards must be those of the session. The packets of the paths are
+// returned by ReadFrom as they arrive, it fails once every path has failed.
+// The probes and the read deadline run on the clock of the first path, which
+// is that of the session, see Clock.
+type MultipathConn struct {
+	enc       *handshakeEncoder
+	block     BlockCrypt
+	probeSize int // the size of a probe packet
+
+	paths     []*multipathPath
+	mode      MultipathMode
+	clock     Clock
+	epoch     time.Time   // the origin of the probe timestamps
+	conv      uint32      // of the session the paths are probed for
+	probes    bool        // the conv is known, the paths are probed
+	stopProbe func() bool // the timer of the next probes
+	weights   []float64   // of the paths scheduled, reused
+	mu        sync.Mutex
+
+	chPackets        chan multipathPacket
+	rd               atomic.Value // read deadline
+	chDeadlineChange chan struct{}
+
+	die     chan struct{}
+	dieOnce sync.Once
+
+	// the read error once every path has failed
+	chReadError   chan struct{}
+	readError     atomic.Value
+	readErrorOnce sync.Once
+}
+
+// NewMultipathConn creates a MultipathConn without any path, 'block',
+// 'dataShards' and 'parityShards' are those of the session
+func NewMultipathConn(block BlockCrypt, dataShards, parityShards int) *MultipathConn {
+	useMTULimit()
+	c := new(MultipathConn)
+	c.enc = newHandshakeEncoder(block, dataShards > 0 && parityShards > 0)
+	c.block = block
+	c.probeSize = c.enc.headerSize + IKCP_OVERHEAD + multipathProbeSize
+	c.clock = SystemClock
+	c.epoch = c.clock.Now()
+	c.chPackets = make(chan multipathPacket, multipathBacklog)
+	c.chDeadlineChange = make(chan struct{}, 1)
+	c.die = make(chan struct{})
+	c.chReadError = make(chan struct{})
+	return c
+}
+
+// Clock returns the clock of the first path, or SystemClock before any path
+// is added
+func (c *MultipathConn) Clock() Clock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clock
+}
+
+// AddPath adds a path sending to 'remote' over 'conn', which is closed with
+// the MultipathConn. The path is probed at once if the session is established.
+func (c *MultipathConn) AddPath(conn net.PacketConn, remote net.Addr) error {
+	c.mu.Lock()
+	select {
+	case <-c.die:
+		c.mu.Unlock()
+		return errBrokenPipe
+	case <-c.chReadError:
+		c.mu.Unlock()
+		return c.readError.Load().(error)
+	default:
+	}
+	if len(c.paths) == 0 {
+		c.clock = connClock(conn)
+		c.epoch = c.clock.Now()
+	}
+	p := &multipathPath{conn: conn, remote: remote, index: uint32(len(c.paths))}
+	c.paths = append(c.paths, p)
+	probes, conv := c.probes, c.conv
+	var payload []byte
+	if probes {
+		payload = c.nextProbe(p)
+	}
+	c.mu.Unlock()
+
+	go c.readLoop(p)
+	if probes {
+		c.sendProbe(p, conv, payload)
+	}
+	return nil
+}
+
+// startProbes starts probing the paths for the session of 'conv', once it's
+// established
+func (c *MultipathConn) startProbes(conv uint32) {
+	c.mu.Lock()
+	if c.probes {
+		c.mu.Unlock()
+		return
+	}
+	c.conv = conv
+	c.probes = true
+	c.mu.Unlock()
+	c.probe()
+}
+
+// SetMode sets the scheduling of the packets, MultipathWeighted by default
+func (c *MultipathConn) SetMode(mode MultipathMode) {
+	c.mu.Lock()
+	c.mode = mode
+	c.mu.Unlock()
+}
+
+// Paths returns the statistics of the paths, in the order they were added
+func (c *MultipathConn) Paths() []PathStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make([]PathStats, len(c.paths))
+	for k, p := range c.paths {
+		stats[k] = PathStats{
+			LocalAddr:  p.conn.LocalAddr(),
+			RemoteAddr: p.remote,
+			RTT:        p.srtt,
+			Loss:       p.loss,
+			Up:         p.up(),
+			TxPackets:  atomic.LoadUint64(&p.txPackets),
+			RxPackets:  atomic.LoadUint64(&p.rxPackets),
+		}
+	}
+	return stats
+}
+
+// readLoop reads a path until it fails, the probes echoed are consumed
+func (c *MultipathConn) readLoop(p *multipathPath) {
+	for {
+		buf := xmitBuf.Get().([]byte)[:mtuLimit]
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			xmitBuf.Put(buf)
+			c.pathFailed(p, err)
+			return
+		}
+		if !authenticated(c.block) && !sameAddr(addr, p.remote) { // anyone can forge a packet in the clear
+			xmitBuf.Put(buf)
+			continue
+		}
+		atomic.AddUint64(&p.rxPackets, 1)
+
+		// only a packet of the size of a probe is decrypted here
+		if n == c.probeSize && c.probeInput(p, buf[:n]) {
+			xmitBuf.Put(buf)
+			continue
+		}
+
+		select {
+		case c.chPackets <- multipathPacket{buf[:n], addr}:
+		case <-c.die:
+			xmitBuf.Put(buf)
+			return
+		}
+	}
+}
+
+// probeInput echoes a probe received on a path, or scores the path from a
+// probe it has echoed, it returns false if the packet is not a probe
+func (c *MultipathConn) probeInput(p *multipathPath, packet []byte) bool {
+	data := make([]byte, len(packet)) // the packet may belong to the session
+	copy(data, packet)
+	data, ok := decryptPacket(c.block, data)
+	if !ok {
+		return false
+	}
+	conv, cmd, payload, ok := parseHandshake(data, c.enc.fec)
+	if !ok || len(payload) != multipathProbeSize {
+		return false
+	}
+	if cmd == IKCP_CMD_PING { // the server challenges the path before migrating to it
+		c.enc.writeTo(p.conn, p.remote, conv, IKCP_CMD_PONG, payload)
+		return true
+	} else if cmd != IKCP_CMD_PONG {
+		return false
+	}
+
+	index := binary.LittleEndian.Uint32(payload)
+	seq := binary.LittleEndian.Uint32(payload[4:])
+	sent := time.Duration(binary.LittleEndian.Uint64(payload[8:]))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rtt := c.clock.Now().Sub(c.epoch) - sent
+	if index != p.index || seq != p.probeSeq || !p.probing || rtt < 0 {
+		return true // a late answer
+	}
+	p.probing = false
+	p.losses = 0
+	p.loss -= p.loss / 8
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt += (rtt - p.srtt) / 8
+	}
+	return true
+}
+
+// pathFailed records a path can't be read anymore, the read error is
+// returned by ReadFrom once every path has failed
+func (c *MultipathConn) pathFailed(p *multipathPath, err error) {
+	c.mu.Lock()
+	p.failed = true
+	for _, p := range c.paths {
+		if !p.failed {
+			c.mu.Unlock()
+			return
+		}
+	}
+	c.readErrorOnce.Do(func() {
+		c.readError.Store(errors.Wrap(err, "ReadFrom"))
+		close(c.chReadError)
+	})
+	c.mu.Unlock()
+}
+
+// probe probes the paths and schedules the next probes on the clock, a probe
+// unanswered by the next one is lost
+func (c *MultipathConn) probe() {
+	c.mu.Lock()
+	select {
+	case <-c.die:
+		c.mu.Unlock()
+		return
+	default:
+	}
+	paths := make([]*multipathPath, 0, len(c.paths))
+	payloads := make([][]byte, 0, len(c.paths))
+	for _, p := range c.paths {
+		if p.failed {
+			continue
+		}
+		if p.probing {
+			p.losses++
+			p.loss += (1 - p.loss) / 8
+		}
+		paths = append(paths, p)
+		payloads = append(payloads, c.nextProbe(p))
+	}
+	conv := c.conv
+	c.stopProbe = afterFunc(c.clock, multipathProbeInterval, c.probe)
+	c.mu.Unlock()
+
+	for k, p := range paths {
+		c.sendProbe(p, conv, payloads[k])
+	}
+}
+
+// nextProbe returns the payload of the next probe of a path, c.mu is held
+func (c *MultipathConn) nextProbe(p *multipathPath) []byte {
+	p.probeSeq++
+	p.probing = true
+	payload := make([]byte, multipathProbeSize)
+	binary.LittleEndian.PutUint32(payload, p.index)
+	binary.LittleEndian.PutUint32(payload[4:], p.probeSeq)
+	binary.LittleEndian.PutUint64(payload[8:], uint64(c.clock.Now().Sub(c.epoch)))
+	return payload
+}
+
+// sendProbe sends a probe of the session of 'conv' on a path, a path whose
+// writes have failed is up again once a probe can be written
+func (c *MultipathConn) sendProbe(p *multipathPath, conv uint32, payload []byte) {
+	err := c.enc.writeTo(p.conn, p.remote, conv, IKCP_CMD_PING, payload)
+	c.mu.Lock()
+	p.writeErr = err != nil
+	c.mu.Unlock()
+}
+
+// schedule appends to 'paths' the paths a packet of 'size' bytes is sent on.
+// With 'all' it's sent on each of them, otherwise on the first one that can be
+// written, the others being the fallbacks.
+func (c *MultipathConn) schedule(paths []*multipathPath, size int) ([]*multipathPath, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.paths {
+		if p.up() {
+			paths = append(paths, p)
+		}
+	}
+
+	// no path known to work, every path is tried
+	if len(paths) == 0 {
+		for _, p := range c.paths {
+			if !p.failed {
+				paths = append(paths, p)
+			}
+		}
+		return paths, true
+	}
+	if c.mode == MultipathRedundant || size <= multipathSmallPacket || len(paths) == 1 {
+		return paths, true
+	}
+
+	// smooth weighted round robin, the paths are weighted alike until they
+	// have all been measured
+	if cap(c.weights) < len(paths) {
+		c.weights = make([]float64, len(paths))
+	}
+	weights := c.weights[:len(paths)]
+	measured := true
+	for k, p := range paths {
+		weights[k] = p.weight()
+		measured = measured && weights[k] > 0
+	}
+	if !measured {
+		for k := range weights {
+			weights[k] = 1
+		}
+	}
+	var total float64
+	best := 0
+	for k, p := range paths {
+		p.current += weights[k]
+		total += weights[k]
+		if p.current > paths[best].current {
+			best = k
+		}
+	}
+	paths[best].current -= total
+	paths[0], paths[best] = paths[best], paths[0]
+	return paths, false
+}
+
+// ReadFrom implements net.PacketConn, it returns the next packet of any path.
+// A blocked read follows the changes of the read deadline.
+func (c *MultipathConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		var timeout <-chan struct{}
+		stop := func() bool { return false }
+		if d, ok := c.rd.Load().(time.Time); ok && !d.IsZero() {
+			clock := c.Clock()
+			wait := d.Sub(clock.Now())
+			if wait <= 0 {
+				return 0, nil, errTimeout{}
+			}
+			timeout, stop = after(clock, wait)
+		}
+
+		select {
+		case pkt := <-c.chPackets:
+			stop()
+			n = copy(b, pkt.data)
+			xmitBuf.Put(pkt.data)
+			return n, pkt.addr, nil
+		case <-timeout:
+			return 0, nil, errTimeout{}
+		case <-c.chReadError:
+			stop()
+			return 0, nil, c.readError.Load().(error)
+		case <-c.die:
+			stop()
+			return 0, nil, errBrokenPipe
+		case <-c.chDeadlineChange:
+			stop()
+		}
+	}
+}
+
+// WriteTo implements net.PacketConn, the packet is scheduled over the paths
+// whatever 'addr'. It fails if the packet couldn't be written on any path.
+func (c *MultipathConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.die:
+		return 0, errBrokenPipe
+	default:
+	}
+
+	var buf [8]*multipathPath
+	paths, all := c.schedule(buf[:0], len(b))
+	err = errNoPath
+	sent := false
+	for _, p := range paths {
+		if _, e := p.conn.WriteTo(b, p.remote); e != nil {
+			c.mu.Lock()
+			p.writeErr = true
+			c.mu.Unlock()
+			err = e
+			continue
+		}
+		atomic.AddUint64(&p.txPackets, 1)
+		sent = true
+		if !all {
+			break
+		}
+	}
+	if !sent {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the connections of all paths
+func (c *MultipathConn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return errBrokenPipe
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopProbe != nil {
+		c.stopProbe()
+	}
+	var err error
+	for _, p := range c.paths {
+		if e := p.conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the first path
+func (c *MultipathConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.paths) == 0 {
+		return nil
+	}
+	return c.paths[0].conn.LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn
+func (c *MultipathConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn, it applies to a blocked read too
+func (c *MultipathConn) SetReadDeadline(t time.Time) error {
+	c.rd.Store(t)
+	select {
+	case c.chDeadlineChange <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the connections of all paths
+func (c *MultipathConn) SetWriteDeadline(t time.Time) error {
+	return c.each(func(conn net.PacketConn) error { return conn.SetWriteDeadline(t) })
+}
+
+// SetDSCP sets the DSCP of the connections of all paths
+func (c *MultipathConn) SetDSCP(dscp int) error {
+	return c.each(func(conn net.PacketConn) error { return setConnDSCP(conn, dscp) })
+}
+
+// SetReadBuffer sets the socket read buffer of the connections of all paths
+func (c *MultipathConn) SetReadBuffer(bytes int) error {
+	return c.each(func(conn net.PacketConn) error {
+		if nc, ok := conn.(setReadBuffer); ok {
+			return nc.SetReadBuffer(bytes)
+		}
+		return errInvalidOperation
+	})
+}
+
+// SetWriteBuffer sets the socket write buffer of the connections of all paths
+func (c *MultipathConn) SetWriteBuffer(bytes int) error {
+	return c.each(func(conn net.PacketConn) error {
+		if nc, ok := conn.(setWriteBuffer); ok {
+			return nc.SetWriteBuffer(bytes)
+		}
+		return errInvalidOperation
+	})
+}
+
+// each applies 'f' to the connections of all paths, it returns the first error
+func (c *MultipathConn) each(f func(conn net.PacketConn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, p := range c.paths {
+		if e := f(p.conn); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package netem
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// a packet on the link, waiting for its delivery time
+type packet struct {
+	bts []byte
+	at  time.Time // delivery time
+	seq uint64    // write order, breaks ties of delivery time
+}
+
+// packetHeap orders the packets on a link by delivery time
+type packetHeap []packet
+
+func (h packetHeap) Len() int { return len(h) }
+func (h packetHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h packetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *packetHeap) Push(x interface{}) { *h = append(*h, x.(packet)) }
+func (h *packetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = packet{}
+	*h = old[:n-1]
+	return x
+}
+
+// link carries the packets of one direction of a pipe
+type link struct {
+	mu    sync.Mutex
+	cfg   Config
+	rng   *rand.Rand
+	burst int       // packets left to drop in the current loss burst
+	busy  time.Time // when the link capacity is free for the next packet
+	queue packetHeap
+	seq   uint64
+	st    Stats
+
+	src, dst *Conn
+	clock    Clock
+	stop     func() bool // stops the timer of the earliest packet
+}
+
+func newLink(cfg Config, src, dst *Conn) *link {
+	l := new(link)
+	l.src = src
+	l.dst = dst
+	l.clock = src.clock
+	l.setConfig(cfg)
+	return l
+}
+
+func (l *link) setConfig(cfg Config) {
+	l.mu.Lock()
+	l.cfg = cfg
+	l.rng = rand.New(rand.NewSource(cfg.Seed))
+	l.burst = 0
+	l.mu.Unlock()
+}
+
+func (l *link) stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.st
+}
+
+// send draws the impairments of a packet and schedules its delivery
+func (l *link) send(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cfg := &l.cfg
+	now := l.clock.Now()
+	l.st.Sent++
+
+	// the time the packet is on the wire for
+	start := now
+	if l.busy.After(now) {
+		start = l.busy
+	}
+	if cfg.Bandwidth > 0 {
+		if cfg.Queue > 0 && int64(start.Sub(now))*int64(cfg.Bandwidth)/int64(time.Second) > int64(cfg.Queue) {
+			l.st.Overflow++
+			return
+		}
+		l.busy = start.Add(time.Duration(int64(len(b)) * int64(time.Second) / int64(cfg.Bandwidth)))
+	} else {
+		l.busy = start
+	}
+
+	// the rng is drawn the same number of times for every packet,
+	// so that a change of one probability doesn't shift the others
+	lost := l.rng.Float64() < cfg.Loss
+	burst := l.rng.Float64() < cfg.BurstLoss
+	burstLen := 0
+	if cfg.BurstLen > 0 {
+		burstLen = 1 + l.rng.Intn(2*cfg.BurstLen-1) // uniform with a mean of BurstLen
+	}
+	jitter := time.Duration(0)
+	if cfg.Jitter > 0 {
+		jitter = time.Duration(l.rng.Int63n(2*int64(cfg.Jitter)+1)) - cfg.Jitter
+	}
+	reorder := l.rng.Float64() < cfg.Reorder
+	duplicate := l.rng.Float64() < cfg.Duplicate
+
+	if l.burst > 0 {
+		l.burst--
+		lost = true
+	} else if burst && burstLen > 0 {
+		l.burst = burstLen - 1
+		lost = true
+	}
+	if lost {
+		l.st.Lost++
+		return
+	}
+
+	at := l.busy
+	if reorder {
+		l.st.Reordered++
+	} else if delay := cfg.Latency + jitter; delay > 0 {
+		at = at.Add(delay)
+	}
+
+	bts := make([]byte, len(b))
+	copy(bts, b)
+	l.push(packet{bts: bts, at: at})
+	if duplicate {
+		l.st.Duplicated++
+		l.push(packet{bts: bts, at: at})
+	}
+}
+
+// push queues a packet and schedules the delivery if it's the earliest
+func (l *link) push(p packet) {
+	p.seq = l.seq
+	l.seq++
+	heap.Push(&l.queue, p)
+	if l.queue[0].seq == p.seq {
+		l.schedule()
+	}
+}
+
+// schedule sets the timer of the earliest packet, with l.mu held
+func (l *link) schedule() {
+	if l.stop != nil {
+		l.stop()
+		l.stop = nil
+	}
+	if len(l.queue) > 0 {
+		l.stop = l.clock.AfterFunc(l.queue[0].at.Sub(l.clock.Now()), l.deliver)
+	}
+}
+
+// deliver hands the packets due to the peer, the packets left on the link
+// are discarded once either end has closed
+func (l *link) deliver() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.src.die:
+		l.queue = nil
+		return
+	case <-l.dst.die:
+		l.queue = nil
+		return
+	default:
+	}
+
+	now := l.clock.Now()
+	for len(l.queue) > 0 && !l.queue[0].at.After(now) {
+		p := heap.Pop(&l.queue).(packet)
+		if l.dst.deliver(message{p.bts, l.src.addr}) {
+			l.st.Delivered++
+		} else {
+			l.st.Overflow++
+		}
+	}
+	l.stop = nil
+	l.schedule()
+}
@@ -0,0 +1,264 @@
+// Package netem emulates an impaired network between a pair of in-process
+// packet connections, with loss, burst loss, latency, jitter, reordering,
+// duplication and a bandwidth cap, for reproducible tests of KCP sessions.
+//
+// Either end of a pipe is a net.PacketConn for kcp.NewConn or kcp.ServeConn:
+//
+//	client, server := netem.Pipe(netem.Config{Loss: 0.05, Seed: 1}, netem.Config{Loss: 0.05, Seed: 2})
+//	l, _ := kcp.ServeConn(nil, 0, 0, server)
+//	s, _ := kcp.NewConn(server.LocalAddr().String(), nil, 0, 0, client)
+//
+// The impairments of each packet are drawn in write order from an RNG seeded
+// by Config.Seed, so the same sequence of writes meets the same fate.
+//
+// A pipe created by PipeWithClock runs on the clock given, a kcp.ManualClock
+// steps the deliveries along with the sessions on the ends:
+//
+//	clock := kcp.NewManualClock(time.Now())
+//	client, server := netem.PipeWithClock(clock, ab, ba)
+//	...
+//	clock.Advance(time.Millisecond)
+package netem
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packets delivered but not read yet, beyond that they're dropped like a full socket buffer
+const recvBuffer = 1024
+
+var errTimeout error = &timeoutError{}
+
+// timeoutError is returned on read or write deadlines
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var errInvalidConfig = errors.New("invalid netem config")
+
+// Clock is the time source of a pipe, the delays of the packets and the
+// deadlines of the ends are timers of the clock. A *kcp.ManualClock is one.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool { return time.AfterFunc(d, f).Stop }
+
+// Config defines the impairments of one direction of a pipe,
+// the zero value is a perfect link
+type Config struct {
+	Loss      float64       // probability of a packet being dropped
+	BurstLoss float64       // probability of a packet starting a loss burst
+	BurstLen  int           // mean number of packets dropped in a loss burst
+	Latency   time.Duration // one-way delay of every packet
+	Jitter    time.Duration // random delay variation within [-Jitter, Jitter], it may reorder packets
+	Reorder   float64       // probability of a packet skipping the latency, overtaking the packets before it
+	Duplicate float64       // probability of a packet being delivered twice
+	Bandwidth int           // link capacity in bytes per second, 0 for unlimited
+	Queue     int           // bytes waiting for the link capacity, beyond that packets are dropped, 0 for unlimited
+	Seed      int64         // seed of the RNG drawing the impairments
+}
+
+func (cfg *Config) validate() error {
+	for _, p := range []float64{cfg.Loss, cfg.BurstLoss, cfg.Reorder, cfg.Duplicate} {
+		if p < 0 || p > 1 {
+			return errInvalidConfig
+		}
+	}
+	if cfg.BurstLen < 0 || cfg.Latency < 0 || cfg.Jitter < 0 || cfg.Bandwidth < 0 || cfg.Queue < 0 {
+		return errInvalidConfig
+	}
+	return nil
+}
+
+// Stats counts the packets written to one end of a pipe
+type Stats struct {
+	Sent       uint64 // packets written
+	Lost       uint64 // packets dropped by random or burst loss
+	Overflow   uint64 // packets dropped by a full link queue or receive buffer
+	Duplicated uint64 // extra copies delivered
+	Reordered  uint64 // packets which skipped the latency
+	Delivered  uint64 // packets, including copies, delivered to the peer
+}
+
+// a packet delivered to a Conn
+type message struct {
+	bts  []byte
+	addr net.Addr
+}
+
+// Conn is one end of an emulated pipe, it implements net.PacketConn
+type Conn struct {
+	addr *net.UDPAddr
+	peer *Conn
+	link *link // for the packets written to this end
+
+	clock Clock // of the delays and the deadlines
+
+	chMessage chan message
+	die       chan struct{}
+	dieOnce   sync.Once
+
+	readDeadline     atomic.Value
+	writeDeadline    atomic.Value
+	chDeadlineChange chan struct{}
+}
+
+// Pipe creates a pair of connected ends, packets written to 'a' reach 'b'
+// through the impairments of 'ab', and those written to 'b' through 'ba'.
+// The ends have addresses from TEST-NET-1, packets written to any address
+// reach the peer. It panics if a config is invalid.
+func Pipe(ab, ba Config) (a, b *Conn) {
+	return PipeWithClock(systemClock{}, ab, ba)
+}
+
+// PipeWithClock creates a pair of connected ends like Pipe, on 'clock'
+// rather than the real time.
+func PipeWithClock(clock Clock, ab, ba Config) (a, b *Conn) {
+	if ab.validate() != nil || ba.validate() != nil {
+		panic(errInvalidConfig)
+	}
+	a = newConn(clock, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+	b = newConn(clock, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2})
+	a.peer, b.peer = b, a
+	a.link = newLink(ab, a, b)
+	b.link = newLink(ba, b, a)
+	return a, b
+}
+
+func newConn(clock Clock, addr *net.UDPAddr) *Conn {
+	c := new(Conn)
+	c.clock = clock
+	c.addr = addr
+	c.chMessage = make(chan message, recvBuffer)
+	c.die = make(chan struct{})
+	c.chDeadlineChange = make(chan struct{}, 1)
+	return c
+}
+
+// SetConfig replaces the impairments of the packets written to this end, the
+// RNG is seeded again by cfg.Seed. Packets already on the link are unaffected.
+func (c *Conn) SetConfig(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	c.link.setConfig(cfg)
+	return nil
+}
+
+// Clock returns the clock of the pipe, the KCP sessions on this end take it
+// as their time source. The result is a kcp.Clock.
+func (c *Conn) Clock() interface{ Now() time.Time } { return c.clock }
+
+// Stats returns the counters of the packets written to this end
+func (c *Conn) Stats() Stats {
+	return c.link.stats()
+}
+
+// deliver queues a packet to be read, it's dropped if the receive buffer is full
+func (c *Conn) deliver(msg message) bool {
+	select {
+	case c.chMessage <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *Conn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		var stop func() bool
+		var deadline chan struct{}
+		if d, ok := c.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+			deadline = make(chan struct{})
+			ch := deadline
+			stop = c.clock.AfterFunc(d.Sub(c.clock.Now()), func() { close(ch) })
+		}
+
+		select {
+		case msg := <-c.chMessage:
+			if stop != nil {
+				stop()
+			}
+			n = copy(p, msg.bts)
+			return n, msg.addr, nil
+		case <-deadline:
+			return 0, nil, errTimeout
+		case <-c.die:
+			if stop != nil {
+				stop()
+			}
+			return 0, nil, io.ErrClosedPipe
+		case <-c.chDeadlineChange:
+			if stop != nil {
+				stop()
+			}
+		}
+	}
+}
+
+// WriteTo implements the PacketConn WriteTo method, the packet is sent to the
+// peer whatever 'addr' is. Dropped packets are reported as written.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.die:
+		return 0, io.ErrClosedPipe
+	case <-c.peer.die:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	if d, ok := c.writeDeadline.Load().(time.Time); ok && !d.IsZero() && !c.clock.Now().Before(d) {
+		return 0, errTimeout
+	}
+
+	c.link.send(p)
+	return len(p), nil
+}
+
+// Close closes this end, the peer fails to write from then on.
+func (c *Conn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.addr }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	select {
+	case c.chDeadlineChange <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(t)
+	return nil
+}
@@ -0,0 +1,65 @@
+package netem
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JimLee1996/tun/kcp"
+)
+
+// the sessions on an end take the clock of the pipe
+var _ interface{ Clock() kcp.Clock } = (*Conn)(nil)
+
+// the packets and the deadlines of a pipe follow its clock
+func TestPipeWithClock(t *testing.T) {
+	clock := kcp.NewManualClock(time.Unix(1e9, 0))
+	a, b := PipeWithClock(clock, Config{Latency: 10 * time.Millisecond}, Config{})
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		n   int
+		err error
+	}
+	read := func() chan result {
+		ch := make(chan result, 1)
+		go func() {
+			n, _, err := b.ReadFrom(make([]byte, 16))
+			ch <- result{n, err}
+		}()
+		return ch
+	}
+	expect := func(ch chan result, done bool) result {
+		select {
+		case r := <-ch:
+			if !done {
+				t.Fatalf("read %v at %v", r, clock.Now())
+			}
+			return r
+		case <-time.After(50 * time.Millisecond):
+			if done {
+				t.Fatalf("no read at %v", clock.Now())
+			}
+		}
+		return result{}
+	}
+
+	ch := read()
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	expect(ch, false)
+	clock.Advance(9 * time.Millisecond)
+	expect(ch, false)
+	clock.Advance(time.Millisecond)
+	if r := expect(ch, true); r.err != nil || r.n != 5 {
+		t.Fatal(r)
+	}
+
+	b.SetReadDeadline(clock.Now().Add(time.Second))
+	ch = read()
+	expect(ch, false)
+	clock.Advance(time.Second)
+	if r := expect(ch, true); r.err == nil || !r.err.(net.Error).Timeout() {
+		t.Fatal(r)
+	}
+}
@@ -0,0 +1,152 @@
+package netem
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/JimLee1996/tun/kcp"
+)
+
+// transferResult is the outcome of a transfer over a pipe
+type transferResult struct {
+	elapsed time.Duration // on the clock of the pipe
+	client  kcp.SessionStats
+	link    Stats // of the packets from the client
+}
+
+// the longest a transfer may take on the clock of the pipe, a stalled window
+// or a collapsed congestion window runs over it
+const transferLimit = 20 * time.Second
+
+// transfer sends 'size' bytes from a client to a server over a pipe stepped
+// by a manual clock, and checks they're received intact
+func transfer(t *testing.T, cfg Config, nc int, size int) transferResult {
+	start := time.Unix(1e9, 0)
+	clock := kcp.NewManualClock(start)
+	back := cfg
+	back.Seed++
+	a, b := PipeWithClock(clock, cfg, back)
+	defer a.Close()
+	defer b.Close()
+
+	// the clock runs much faster than real time, but lets the read loops
+	// of the sessions catch up on every step
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			clock.Advance(time.Millisecond)
+			time.Sleep(20 * time.Microsecond)
+		}
+	}()
+
+	l, err := kcp.ServeConn(nil, 0, 0, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(1, 10, 2, nc)
+		s.SetWindowSize(128, 128)
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			buf = nil
+		}
+		received <- buf
+	}()
+
+	c, err := kcp.NewConn(b.LocalAddr().String(), nil, 0, 0, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetNoDelay(1, 10, 2, nc)
+	c.SetWindowSize(128, 128)
+	data := make([]byte, size)
+	rand.New(rand.NewSource(cfg.Seed)).Read(data)
+	go c.Write(data)
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Fatal("data corrupted")
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("transfer stalled at", clock.Now().Sub(start), c.Stats())
+	}
+	return transferResult{clock.Now().Sub(start), c.Stats(), a.Stats()}
+}
+
+// the lost segments are retransmitted, without flooding the link with
+// spurious retransmissions, and the transfer keeps going with the
+// congestion window on
+func TestTransferLoss(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		nc   int
+	}{
+		{"random", Config{Loss: 0.05, Latency: 10 * time.Millisecond, Seed: 1}, 1},
+		{"random cwnd", Config{Loss: 0.05, Latency: 10 * time.Millisecond, Seed: 2}, 0},
+		{"burst", Config{BurstLoss: 0.01, BurstLen: 8, Latency: 10 * time.Millisecond, Seed: 3}, 1},
+		{"burst cwnd", Config{BurstLoss: 0.01, BurstLen: 8, Latency: 10 * time.Millisecond, Seed: 4}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := transfer(t, tt.cfg, tt.nc, 256<<10)
+			t.Logf("%v elapsed, %+v, %+v", r.elapsed, r.client, r.link)
+			if r.link.Lost == 0 {
+				t.Fatal("no loss")
+			}
+			if r.client.RetransSegs < r.link.Lost/2 {
+				t.Fatalf("%v segments retransmitted for %v lost", r.client.RetransSegs, r.link.Lost)
+			}
+			if r.elapsed > transferLimit {
+				t.Fatal("too slow:", r.elapsed)
+			}
+		})
+	}
+}
+
+// the segments arriving out of order are put back in order, and recovered
+// by fast retransmission rather than by timeouts
+func TestTransferReorder(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"reorder", Config{Reorder: 0.1, Latency: 10 * time.Millisecond, Seed: 5}},
+		{"jitter", Config{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 6}},
+		{"duplicate", Config{Reorder: 0.05, Duplicate: 0.05, Latency: 10 * time.Millisecond, Seed: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := transfer(t, tt.cfg, 0, 256<<10)
+			t.Logf("%v elapsed, %+v, %+v", r.elapsed, r.client, r.link)
+			if tt.cfg.Reorder > 0 && r.link.Reordered == 0 {
+				t.Fatal("no reordering")
+			}
+			if r.client.LostSegs > r.client.SegsSent/20 {
+				t.Fatalf("%v of %v segments timed out", r.client.LostSegs, r.client.SegsSent)
+			}
+			if r.elapsed > transferLimit {
+				t.Fatal("too slow:", r.elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package kcp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// the longest delay a packet may be queued in the pacer,
+	// packets beyond that are dropped like a traffic shaper does
+	pacerMaxDelay = 100 * time.Millisecond
+
+	// the queue holds at least these full-sized packets regardless of the rate
+	pacerMinQueue = 16
+
+	// tokens accumulated while idle allow a burst of at least these full-sized packets
+	pacerMinBurst = 2
+)
+
+// pacer spreads the packets of a session over time at a given rate, rather
+// than writing all packets of a flush to the socket in one burst.
+type pacer struct {
+	mu       sync.Mutex
+	queue    [][]byte  // packets waiting for tokens, allocated from xmitBuf
+	queued   int       // bytes in queue
+	rate     uint64    // bytes per second, 0 for unlimited
+	limit    uint64    // the rate limit bounding the queue, 0 for unbounded
+	tokens   float64   // bytes allowed to send
+	ts       time.Time // last time the tokens were refilled
+	chNotify chan struct{}
+}
+
+// newPacer creates a pacer with no tokens at 'now'
+func newPacer(now time.Time) *pacer {
+	p := new(pacer)
+	p.chNotify = make(chan struct{}, 1)
+	p.ts = now
+	return p
+}
+
+// setRate changes the pacing rate in bytes per second, and the rate limit
+// the queue is bounded by, 0 for unlimited
+func (p *pacer) setRate(rate, limit uint64) {
+	p.mu.Lock()
+	p.rate = rate
+	p.limit = limit
+	p.mu.Unlock()
+	p.notify()
+}
+
+// backlog returns the bytes waiting in the queue
+func (p *pacer) backlog() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queued
+}
+
+// push copies a packet into the queue, returns false if it has been dropped
+// because the queue is full
+func (p *pacer) push(b []byte) bool {
+	p.mu.Lock()
+	if p.limit > 0 {
+		limit := int(p.limit * uint64(pacerMaxDelay) / uint64(time.Second))
+		if limit < pacerMinQueue*mtuLimit {
+			limit = pacerMinQueue * mtuLimit
+		}
+		if p.queued+len(b) > limit {
+			p.mu.Unlock()
+			return false
+		}
+	}
+	pkt := xmitBuf.Get().([]byte)[:len(b)]
+	copy(pkt, b)
+	p.queue = append(p.queue, pkt)
+	p.queued += len(pkt)
+	p.mu.Unlock()
+	p.notify()
+	return true
+}
+
+// pop removes the packet at the head of the queue if the tokens allow,
+// otherwise returns how long to wait for them, or 0 if the queue is empty
+func (p *pacer) pop(now time.Time) (pkt []byte, wait time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// refill
+	if p.rate > 0 {
+		p.tokens += now.Sub(p.ts).Seconds() * float64(p.rate)
+		burst := float64(p.rate) * 2 * float64(time.Millisecond) / float64(time.Second)
+		if burst < float64(pacerMinBurst*mtuLimit) {
+			burst = float64(pacerMinBurst * mtuLimit)
+		}
+		if p.tokens > burst {
+			p.tokens = burst
+		}
+	}
+	p.ts = now
+
+	if len(p.queue) == 0 {
+		return nil, 0
+	}
+
+	if p.rate > 0 && p.tokens <= 0 {
+		wait = time.Duration(-p.tokens / float64(p.rate) * float64(time.Second))
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+		return nil, wait
+	}
+
+	pkt = p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	p.queued -= len(pkt)
+	if p.rate > 0 {
+		p.tokens -= float64(len(pkt))
+	}
+	return pkt, 0
+}
+
+// clear recycles all packets in the queue
+func (p *pacer) clear() {
+	p.mu.Lock()
+	for k := range p.queue {
+		xmitBuf.Put(p.queue[k])
+		p.queue[k] = nil
+	}
+	p.queue = p.queue[:0]
+	p.queued = 0
+	p.mu.Unlock()
+}
+
+func (p *pacer) notify() {
+	select {
+	case p.chNotify <- struct{}{}:
+	default:
+	}
+}
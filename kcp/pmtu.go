@@ -0,0 +1,139 @@
+package kcp
+
+import "time"
+
+const (
+	// the packet size every path is assumed to carry,
+	// it fits in the minimum IPv6 MTU with IP and UDP headers
+	pmtuBase = 1200
+
+	// the search stops when the sizes passed and failed are this close
+	pmtuStep = 16
+
+	// transmissions of a probe before its size is considered failed
+	pmtuTries = 2
+
+	// the path mtu is searched again after this duration
+	pmtuReprobeInterval = 10 * time.Minute
+)
+
+// pmtuProber searches the largest packet size a path carries without
+// fragmentation, by sending DF-marked probes of the size between one known to
+// pass and one known to fail, the peer acknowledges the probes it receives.
+type pmtuProber struct {
+	low, high  int       // the sizes known to pass and to fail
+	probing    int       // the size of the probe in flight, 0 for none
+	tries      int       // transmissions of the probe in flight
+	deadline   time.Time // when the probe in flight times out
+	nextSearch time.Time // when to search again once converged
+	converged  bool
+}
+
+// restart begins a new search between pmtuBase and mtuLimit
+func (p *pmtuProber) restart() {
+	p.low = pmtuBase
+	p.high = mtuLimit + 1
+	p.probing = 0
+	p.tries = 0
+	p.converged = false
+}
+
+// SetPMTUDiscovery toggles path MTU discovery. When enabled, the packets are
+// sent with the DF bit, the MTU starts from a size every path is assumed to
+// carry, and is adjusted to the largest size the probes confirm, up to the
+// MTU limit. The path is searched again every 10 minutes and on roaming.
+//
+// Segments already queued keep their size when the MTU is lowered. It returns
+// an error if the DF bit can't be set on the underlying connection, for a
+// session accepted by a Listener the DF bit is set on the shared socket.
+func (s *UDPSession) SetPMTUDiscovery(enable bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !enable {
+		s.pmtu = nil
+		return nil
+	}
+
+	if s.pmtu == nil {
+		if err := setDF(s.conn); err != nil {
+			return err
+		}
+		s.pmtu = new(pmtuProber)
+		s.pmtu.restart()
+		if int(s.kcp.mtu)+s.headerSize > pmtuBase {
+			s.kcp.SetMtu(pmtuBase - s.headerSize)
+		}
+		s.wakeIdle()
+	}
+	return nil
+}
+
+// pmtuUpdate advances the path mtu search, it's called by update()
+func (s *UDPSession) pmtuUpdate(now time.Time) {
+	p := s.pmtu
+	if p.probing != 0 {
+		if s.kcp.pmtuAcked == uint32(p.probing) {
+			p.low = p.probing
+		} else if now.Before(p.deadline) {
+			return
+		} else if p.tries < pmtuTries {
+			s.sendPmtuProbe(p.probing, now)
+			return
+		} else {
+			p.high = p.probing
+		}
+		p.probing = 0
+	}
+
+	if p.high-p.low <= pmtuStep {
+		if !p.converged {
+			p.converged = true
+			p.nextSearch = now.Add(pmtuReprobeInterval)
+			s.kcp.SetMtu(p.low - s.headerSize)
+		}
+		if now.Before(p.nextSearch) {
+			return
+		}
+		p.restart()
+	}
+
+	p.tries = 0
+	s.kcp.pmtuAcked = 0
+	s.sendPmtuProbe((p.low+p.high)/2, now)
+}
+
+// sendPmtuProbe writes a probe of 'size' bytes to the socket directly,
+// bypassing FEC groups, the write errors on oversized probes are ignored
+func (s *UDPSession) sendPmtuProbe(size int, now time.Time) {
+	p := s.pmtu
+	p.probing = size
+	p.tries++
+	timeout := time.Duration(_imax_(s.kcp.rx_rto, IKCP_RTO_MIN)+s.kcp.interval) * time.Millisecond
+	p.deadline = now.Add(timeout)
+
+	buf := xmitBuf.Get().([]byte)[:size]
+	for k := range buf { // the padding mustn't leak previous packets
+		buf[k] = 0
+	}
+	s.kcp.encodePmtuProbe(buf[s.headerSize:], uint32(size))
+	if s.fecEncoder != nil {
+		s.fecEncoder.markRaw(buf)
+	}
+	if s.block != nil {
+		s.encrypt(buf)
+	}
+	s.conn.WriteTo(buf, s.remote)
+	xmitBuf.Put(buf)
+}
+
+// pmtuRoam restarts the search from the base size after the remote address
+// has changed, as the new path may carry less than the old one
+func (s *UDPSession) pmtuRoam() {
+	if s.pmtu == nil {
+		return
+	}
+	s.pmtu.restart()
+	if int(s.kcp.mtu)+s.headerSize > pmtuBase {
+		s.kcp.SetMtu(pmtuBase - s.headerSize)
+	}
+}
@@ -0,0 +1,18 @@
+package kcp
+
+import "testing"
+
+func TestSetMTULimitAfterUse(t *testing.T) {
+	if err := SetMTULimit(maxMtuLimit + 1); err == nil {
+		t.Fatal("limit out of range accepted")
+	}
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	limit := mtuLimit
+	if err := SetMTULimit(9000); err == nil || mtuLimit != limit {
+		t.Fatal("limit changed after a listener was created", mtuLimit)
+	}
+}
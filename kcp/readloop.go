@@ -0,0 +1,242 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+// the default read loop for a client session, one packet per syscall
+func (s *UDPSession) defaultReadLoop() {
+	buf := make([]byte, mtuLimit)
+	for {
+		if n, addr, err := s.conn.ReadFrom(buf); err == nil {
+			s.packetInput(buf[:n], addr)
+		} else {
+			s.chReadError <- err
+			return
+		}
+	}
+}
+
+// packetInput decrypts and verifies a packet read from the socket,
+// and feeds it into the session
+func (s *UDPSession) packetInput(data []byte, addr net.Addr) {
+	if !s.fromRemote(addr) {
+		return
+	}
+	if len(data) < s.headerSize+IKCP_OVERHEAD {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return
+	}
+
+	data, dataValid := decryptPacket(s.block, data)
+	if !dataValid {
+		atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+		return
+	}
+
+	// the answers to the retransmissions of the handshake arrive late
+	if _, _, _, ok := parseHandshake(data, s.fecDecoder != nil); ok {
+		return
+	}
+	s.kcpInput(data, nil, nil)
+}
+
+// parityRoute finds the session of the FEC parity packets read on a socket.
+// They carry no conv, but follow the data packets of their group from the same
+// sender, so they go to the session of the last data packet from their address.
+// This tells apart the sessions sharing a socket on the remote side.
+type parityRoute struct {
+	addr net.Addr
+	s    *UDPSession
+}
+
+// see records a data packet of 's' from 'addr'
+func (r *parityRoute) see(addr net.Addr, s *UDPSession) {
+	r.addr = addr
+	r.s = s
+}
+
+// lookup returns the session of the last data packet from 'addr', nil if unknown
+func (r *parityRoute) lookup(addr net.Addr) *UDPSession {
+	if r.s == nil || !sameAddr(r.addr, addr) {
+		return nil
+	}
+	return r.s
+}
+
+// sameAddr compares two addresses without allocating for UDP addresses
+func sameAddr(a, b net.Addr) bool {
+	if ua, ok := a.(*net.UDPAddr); ok {
+		if ub, ok := b.(*net.UDPAddr); ok {
+			return ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+		}
+	}
+	return a.String() == b.String()
+}
+
+// the default monitor of a listener shard, one packet per syscall
+func (l *Listener) defaultMonitor(conn net.PacketConn) {
+	var route parityRoute
+	buf := make([]byte, mtuLimit)
+	for {
+		if n, from, err := conn.ReadFrom(buf); err == nil {
+			l.packetInput(buf[:n], from, conn, &route)
+		} else {
+			l.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// packetInput decrypts and verifies a packet read from the socket 'conn', and
+// dispatches it to the session of the sender, or to the handshake
+func (l *Listener) packetInput(data []byte, addr net.Addr, conn net.PacketConn, route *parityRoute) {
+	if len(data) < l.headerSize+IKCP_OVERHEAD {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return
+	}
+
+	data, dataValid := decryptPacket(l.block, data)
+	if !dataValid {
+		atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+		return
+	}
+
+	if conv, cmd, payload, ok := parseHandshake(data, l.fecDecoder != nil); ok {
+		l.handshake(conv, cmd, payload, addr, conn)
+		return
+	}
+
+	// sessions are keyed by conv so that they survive address changes,
+	// FEC parity packets carry no conv and follow the data packets, or go
+	// to the latest session of the address
+	var conv uint32
+	convValid := false
+	if l.fecDecoder != nil {
+		isfec := binary.LittleEndian.Uint16(data[4:])
+		if isfec == typeData || isfec == typeRaw {
+			conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
+			convValid = true
+		}
+	} else {
+		conv = binary.LittleEndian.Uint32(data)
+		convValid = true
+	}
+
+	var s *UDPSession
+	var ok bool
+	l.sessionLock.Lock()
+	if convValid {
+		s, ok = l.sessions[conv]
+	} else if s = route.lookup(addr); s != nil {
+		ok = true
+	} else {
+		s, ok = l.sessionsByAddr[addr.String()]
+	}
+	l.sessionLock.Unlock()
+
+	// the sessions are only created by the handshake,
+	// the packets of an unknown conv are dropped
+	if !ok {
+		return
+	}
+	if convValid {
+		route.see(addr, s)
+	}
+
+	s.kcpInput(data, addr, conn)
+	l.sessionPathsChanged(s)
+}
+
+// sessionPathsChanged rekeys a session by the addresses of the paths it has
+// learned and forgotten, the migrations between known paths rekey nothing
+func (l *Listener) sessionPathsChanged(s *UDPSession) {
+	learned, forgotten := s.pathChanges()
+	if learned == nil && forgotten == nil {
+		return
+	}
+	l.sessionLock.Lock()
+	defer l.sessionLock.Unlock()
+	for _, addr := range forgotten {
+		if l.sessionsByAddr[addr] == s {
+			delete(l.sessionsByAddr, addr)
+		}
+	}
+	for _, addr := range learned {
+		l.sessionsByAddr[addr] = s
+	}
+}
+
+// the default read loop of a Dialer, one packet per syscall
+func (d *Dialer) defaultMonitor() {
+	var route parityRoute
+	buf := make([]byte, mtuLimit)
+	for {
+		if n, from, err := d.conn.ReadFrom(buf); err == nil {
+			d.packetInput(buf[:n], from, &route)
+		} else {
+			d.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// packetInput decrypts and verifies a packet read from the shared connection,
+// and dispatches it to the session of its conv, or to the handshake
+func (d *Dialer) packetInput(data []byte, addr net.Addr, route *parityRoute) {
+	if len(data) < d.headerSize+IKCP_OVERHEAD {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return
+	}
+
+	data, dataValid := decryptPacket(d.block, data)
+	if !dataValid {
+		atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+		return
+	}
+
+	fec := d.dataShards > 0 && d.parityShards > 0
+	if conv, _, _, ok := parseHandshake(data, fec); ok {
+		d.sessionLock.Lock()
+		ch, ok := d.handshakes[conv]
+		d.sessionLock.Unlock()
+		if ok {
+			select {
+			case ch <- append([]byte(nil), data...):
+			default:
+			}
+		}
+		return
+	}
+
+	// FEC parity packets carry no conv and follow the data packets
+	var conv uint32
+	convValid := false
+	if fec {
+		isfec := binary.LittleEndian.Uint16(data[4:])
+		if isfec == typeData || isfec == typeRaw {
+			conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
+			convValid = true
+		}
+	} else {
+		conv = binary.LittleEndian.Uint32(data)
+		convValid = true
+	}
+
+	var s *UDPSession
+	if convValid {
+		d.sessionLock.Lock()
+		s = d.sessions[conv]
+		d.sessionLock.Unlock()
+		if s != nil {
+			route.see(addr, s)
+		}
+	} else {
+		s = route.lookup(addr)
+	}
+	if s != nil && s.fromRemote(addr) {
+		s.kcpInput(data, nil, nil)
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package kcp
+
+import "net"
+
+func (s *UDPSession) readLoop() {
+	s.defaultReadLoop()
+}
+
+func (l *Listener) monitor(conn net.PacketConn) {
+	l.defaultMonitor(conn)
+}
+
+func (d *Dialer) monitor() {
+	d.defaultMonitor()
+}
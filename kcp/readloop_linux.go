@@ -0,0 +1,124 @@
+// +build linux
+
+package kcp
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/net/ipv4"
+)
+
+// the read loop for a client session, reads packets in batch with recvmmsg
+// if the connection supports it
+func (s *UDPSession) readLoop() {
+	if s.xconn == nil {
+		s.defaultReadLoop()
+		return
+	}
+
+	msgs := make([]ipv4.Message, batchSize)
+	for k := range msgs {
+		msgs[k].Buffers = [][]byte{make([]byte, mtuLimit)}
+	}
+
+	for {
+		if count, err := s.xconn.ReadBatch(msgs, 0); err == nil {
+			for i := 0; i < count; i++ {
+				msg := &msgs[i]
+				s.packetInput(msg.Buffers[0][:msg.N], msg.Addr)
+			}
+		} else {
+			// compatibility issue:
+			// for linux kernel<=2.6.32, support for recvmmsg is not available
+			if isSyscallError(err, "recvmmsg") {
+				s.defaultReadLoop()
+				return
+			}
+			s.chReadError <- err
+			return
+		}
+	}
+}
+
+// monitor incoming data of a listener shard for all connections of server,
+// reads packets in batch with recvmmsg if the connection supports it
+func (l *Listener) monitor(conn net.PacketConn) {
+	var xconn batchConn
+	if _, ok := conn.(*net.UDPConn); ok {
+		xconn = newBatchConn(conn)
+	}
+
+	if xconn == nil {
+		l.defaultMonitor(conn)
+		return
+	}
+
+	var route parityRoute
+	msgs := make([]ipv4.Message, batchSize)
+	for k := range msgs {
+		msgs[k].Buffers = [][]byte{make([]byte, mtuLimit)}
+	}
+
+	for {
+		if count, err := xconn.ReadBatch(msgs, 0); err == nil {
+			for i := 0; i < count; i++ {
+				msg := &msgs[i]
+				l.packetInput(msg.Buffers[0][:msg.N], msg.Addr, conn, &route)
+			}
+		} else {
+			if isSyscallError(err, "recvmmsg") {
+				l.defaultMonitor(conn)
+				return
+			}
+			l.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// the read loop of a Dialer, reads packets in batch with recvmmsg if the
+// connection supports it
+func (d *Dialer) monitor() {
+	var xconn batchConn
+	if _, ok := d.conn.(*net.UDPConn); ok {
+		xconn = newBatchConn(d.conn)
+	}
+
+	if xconn == nil {
+		d.defaultMonitor()
+		return
+	}
+
+	var route parityRoute
+	msgs := make([]ipv4.Message, batchSize)
+	for k := range msgs {
+		msgs[k].Buffers = [][]byte{make([]byte, mtuLimit)}
+	}
+
+	for {
+		if count, err := xconn.ReadBatch(msgs, 0); err == nil {
+			for i := 0; i < count; i++ {
+				msg := &msgs[i]
+				d.packetInput(msg.Buffers[0][:msg.N], msg.Addr, &route)
+			}
+		} else {
+			if isSyscallError(err, "recvmmsg") {
+				d.defaultMonitor()
+				return
+			}
+			d.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// isSyscallError checks if err is an os.SyscallError from the given syscall
+func isSyscallError(err error, syscall string) bool {
+	if operr, ok := err.(*net.OpError); ok {
+		if se, ok := operr.Err.(*os.SyscallError); ok {
+			return se.Syscall == syscall
+		}
+	}
+	return false
+}
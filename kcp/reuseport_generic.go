@@ -0,0 +1,12 @@
+// +build !linux
+
+package kcp
+
+import "net"
+
+// SO_REUSEPORT doesn't balance the remotes over the sockets on other platforms
+const reusePortSupported = false
+
+func listenReusePort(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	return nil, errInvalidOperation
+}
@@ -0,0 +1,31 @@
+// +build linux
+
+package kcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// the kernel balances the remotes over the sockets sharing a port
+const reusePortSupported = true
+
+// listenReusePort listens on laddr of 'network' with SO_REUSEPORT set,
+// so that multiple sockets can bind to the same address
+func listenReusePort(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var opErr error
+			if err := c.Control(func(fd uintptr) {
+				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return opErr
+		},
+	}
+	return lc.ListenPacket(context.Background(), network, laddr.String())
+}
@@ -0,0 +1,115 @@
+package kcp
+
+// the initial capacity of the segment rings, a power of 2
+const ringMinCap = 32
+
+// segmentQueue is a FIFO of segments in a ring buffer, the capacity grows by
+// powers of 2 and is kept, so that a steady flow of segments never allocates
+type segmentQueue struct {
+	segs []segment
+	head int // index of the front segment
+	n    int // number of segments
+}
+
+// Len returns the number of segments in the queue
+func (q *segmentQueue) Len() int { return q.n }
+
+// at returns the i-th segment from the front
+func (q *segmentQueue) at(i int) *segment {
+	return &q.segs[(q.head+i)&(len(q.segs)-1)]
+}
+
+// front returns the front segment of a non-empty queue
+func (q *segmentQueue) front() *segment { return q.at(0) }
+
+// back returns the back segment of a non-empty queue
+func (q *segmentQueue) back() *segment { return q.at(q.n - 1) }
+
+// push appends a segment to the back
+func (q *segmentQueue) push(seg segment) {
+	if q.n == len(q.segs) {
+		q.grow()
+	}
+	q.segs[(q.head+q.n)&(len(q.segs)-1)] = seg
+	q.n++
+}
+
+// pop removes 'n' segments from the front, the caller recycles their data
+func (q *segmentQueue) pop(n int) {
+	for i := 0; i < n; i++ {
+		*q.at(i) = segment{}
+	}
+	q.head = (q.head + n) & (len(q.segs) - 1)
+	q.n -= n
+}
+
+func (q *segmentQueue) grow() {
+	newcap := 2 * len(q.segs)
+	if newcap < ringMinCap {
+		newcap = ringMinCap
+	}
+	segs := make([]segment, newcap)
+	for i := 0; i < q.n; i++ {
+		segs[i] = *q.at(i)
+	}
+	q.segs = segs
+	q.head = 0
+}
+
+// segmentWindow holds the segments received out of order, a segment of sn is
+// kept in the slot sn modulo the capacity, which covers the receive window
+type segmentWindow struct {
+	segs []segment // a slot is empty if its data is nil
+	n    int       // number of segments
+}
+
+// Len returns the number of segments in the window
+func (w *segmentWindow) Len() int { return w.n }
+
+// reserve makes the window cover 'wnd' consecutive sn
+func (w *segmentWindow) reserve(wnd uint32) {
+	if int(wnd) <= len(w.segs) {
+		return
+	}
+	newcap := ringMinCap
+	for newcap < int(wnd) {
+		newcap *= 2
+	}
+	segs := make([]segment, newcap)
+	for k := range w.segs {
+		if seg := &w.segs[k]; seg.data != nil {
+			segs[seg.sn&uint32(newcap-1)] = *seg
+		}
+	}
+	w.segs = segs
+}
+
+// get returns the segment of 'sn', nil if it's not in the window
+func (w *segmentWindow) get(sn uint32) *segment {
+	if len(w.segs) == 0 {
+		return nil
+	}
+	seg := &w.segs[sn&uint32(len(w.segs)-1)]
+	if seg.data == nil || seg.sn != sn {
+		return nil
+	}
+	return seg
+}
+
+// put stores a segment with non-nil data, its slot must be empty
+func (w *segmentWindow) put(seg segment) {
+	w.segs[seg.sn&uint32(len(w.segs)-1)] = seg
+	w.n++
+}
+
+// take removes the segment of 'sn' from the window and returns it
+func (w *segmentWindow) take(sn uint32) (seg segment, ok bool) {
+	p := w.get(sn)
+	if p == nil {
+		return segment{}, false
+	}
+	seg = *p
+	*p = segment{}
+	w.n--
+	return seg, true
+}
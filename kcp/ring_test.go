@@ -0,0 +1,175 @@
+package kcp
+
+import "testing"
+
+// the queue keeps the order of the segments, across the end of its ring
+// and while it grows, and clears the slots it pops
+func TestSegmentQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []int // pushes n segments if n > 0, pops -n otherwise
+		cap   int   // the capacity in the end
+	}{
+		{"empty", nil, 0},
+		{"fill", []int{ringMinCap}, ringMinCap},
+		{"wraparound", []int{ringMinCap, -20, 20, -ringMinCap, 5}, ringMinCap},
+		{"growth", []int{ringMinCap + 1}, 2 * ringMinCap},
+		{"growth wrapped", []int{ringMinCap, -10, 10, 1, -30, 60}, 2 * ringMinCap},
+		{"slot reuse", []int{10, -10, 10, -10, 10, -10, 10, -10}, ringMinCap},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q segmentQueue
+			var model []uint32
+			sn := uint32(0)
+			for _, n := range tt.steps {
+				if n > 0 {
+					for i := 0; i < n; i++ {
+						q.push(segment{sn: sn, data: []byte{byte(sn)}})
+						model = append(model, sn)
+						sn++
+					}
+				} else {
+					q.pop(-n)
+					model = model[-n:]
+				}
+				if q.Len() != len(model) {
+					t.Fatalf("len %v, want %v", q.Len(), len(model))
+				}
+				for i, want := range model {
+					if seg := q.at(i); seg.sn != want || seg.data[0] != byte(want) {
+						t.Fatalf("segment %v is %v, want %v", i, seg.sn, want)
+					}
+				}
+				if len(model) > 0 && (q.front().sn != model[0] || q.back().sn != model[len(model)-1]) {
+					t.Fatalf("front %v back %v, want %v", q.front().sn, q.back().sn, model)
+				}
+			}
+			if len(q.segs) != tt.cap {
+				t.Fatalf("capacity %v, want %v", len(q.segs), tt.cap)
+			}
+			for i := q.n; i < len(q.segs); i++ {
+				if seg := q.at(i); seg.data != nil {
+					t.Fatalf("free slot %v holds segment %v", i, seg.sn)
+				}
+			}
+		})
+	}
+}
+
+// a segment is found by its sn only, whichever segments share its slot,
+// across the wraparound of sn and the growth of the window
+func TestSegmentWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		wnd     uint32 // the window reserved first
+		base    uint32 // the first sn
+		put     []uint32
+		grow    uint32 // the window reserved after putting, 0 to keep it
+		take    []uint32
+		missing []uint32 // not in the window after taking
+	}{
+		{"in order", 32, 0, []uint32{0, 1, 2}, 0, []uint32{0, 1, 2}, []uint32{0, 32}},
+		{"out of order", 32, 100, []uint32{3, 1, 2, 0}, 0, []uint32{0, 1, 2, 3}, nil},
+		{"sn wraparound", 32, 0xFFFFFFF0, []uint32{15, 16, 17, 31}, 0, []uint32{15, 16, 17}, []uint32{16, 48}},
+		{"aliased slot", 32, 0, []uint32{5}, 0, nil, []uint32{37, 69}},
+		{"growth", 32, 30, []uint32{0, 1, 2, 31}, 100, []uint32{0, 1, 2, 31}, []uint32{32, 64}},
+		{"window rounded up", 33, 0, []uint32{0, 40, 63}, 0, []uint32{0, 40, 63}, nil},
+		{"slot reuse", 32, 0, []uint32{1, 2}, 0, []uint32{1, 2}, []uint32{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w segmentWindow
+			if w.get(tt.base) != nil {
+				t.Fatal("segment in an empty window")
+			}
+			w.reserve(tt.wnd)
+			for _, off := range tt.put {
+				sn := tt.base + off
+				w.put(segment{sn: sn, data: []byte{byte(sn)}})
+			}
+			if tt.grow > 0 {
+				w.reserve(tt.grow)
+				if len(w.segs) < int(tt.grow) {
+					t.Fatalf("capacity %v, want %v", len(w.segs), tt.grow)
+				}
+			}
+			if w.Len() != len(tt.put) {
+				t.Fatalf("len %v, want %v", w.Len(), len(tt.put))
+			}
+			for _, off := range tt.put {
+				if seg := w.get(tt.base + off); seg == nil || seg.data[0] != byte(tt.base+off) {
+					t.Fatalf("segment %v not found", tt.base+off)
+				}
+			}
+			for _, off := range tt.take {
+				seg, ok := w.take(tt.base + off)
+				if !ok || seg.sn != tt.base+off {
+					t.Fatalf("segment %v not taken", tt.base+off)
+				}
+			}
+			if w.Len() != len(tt.put)-len(tt.take) {
+				t.Fatalf("len %v after taking, want %v", w.Len(), len(tt.put)-len(tt.take))
+			}
+			for _, off := range tt.missing {
+				if w.get(tt.base+off) != nil {
+					t.Fatalf("segment %v found", tt.base+off)
+				}
+				if _, ok := w.take(tt.base + off); ok {
+					t.Fatalf("segment %v taken", tt.base+off)
+				}
+			}
+
+			// the slots taken are free for the next revolution
+			for _, off := range tt.take {
+				sn := tt.base + off + uint32(len(w.segs))
+				w.put(segment{sn: sn, data: []byte{byte(sn)}})
+				if seg, ok := w.take(sn); !ok || seg.sn != sn {
+					t.Fatalf("slot of %v not reused", sn)
+				}
+			}
+		})
+	}
+}
+
+// a send queue of 4096 segments, with one segment acknowledged and one
+// queued per operation
+func BenchmarkSegmentQueue4096(b *testing.B) {
+	const wnd = 4096
+	var q segmentQueue
+	data := make([]byte, 1)
+	for i := 0; i < wnd; i++ {
+		q.push(segment{sn: uint32(i), data: data})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.pop(1)
+		q.push(segment{sn: uint32(wnd + i), data: data})
+	}
+}
+
+// a receive window of 4096 segments, filled in reverse order and drained in
+// order, per 4096 operations
+func BenchmarkSegmentWindow4096(b *testing.B) {
+	const wnd = 4096
+	var w segmentWindow
+	w.reserve(wnd)
+	data := make([]byte, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += wnd {
+		base := uint32(i)
+		for k := wnd - 1; k >= 0; k-- {
+			sn := base + uint32(k)
+			if w.get(sn) == nil {
+				w.put(segment{sn: sn, data: data})
+			}
+		}
+		for k := 0; k < wnd; k++ {
+			w.take(base + uint32(k))
+		}
+	}
+}
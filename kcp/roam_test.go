@@ -0,0 +1,211 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natConn is a client socket whose NAT mapping changes on rebind
+type natConn struct {
+	net.PacketConn
+	mu sync.Mutex
+}
+
+func (c *natConn) socket() net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PacketConn
+}
+
+func (c *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		conn := c.socket()
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil && c.socket() != conn { // rebound meanwhile
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (c *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.socket().WriteTo(b, addr)
+}
+
+func (c *natConn) LocalAddr() net.Addr { return c.socket().LocalAddr() }
+func (c *natConn) Close() error        { return c.socket().Close() }
+
+func (c *natConn) rebind(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	old := c.PacketConn
+	c.PacketConn = conn
+	c.mu.Unlock()
+	old.Close()
+}
+
+// a session follows its client to a new address only if the packets are
+// authenticated by a key
+func TestRoam(t *testing.T) {
+	salsa20, _ := NewSalsa20BlockCrypt(make([]byte, 32))
+	none, _ := NewNoneBlockCrypt(nil)
+	tests := []struct {
+		name    string
+		block   BlockCrypt
+		migrate bool
+	}{
+		{"salsa20", salsa20, true},
+		{"none", none, false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := ListenWithOptions("127.0.0.1:0", tt.block, 0, 0, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			accepted := make(chan *UDPSession, 1)
+			go func() {
+				if s, err := l.AcceptKCP(); err == nil {
+					accepted <- s
+					io.Copy(s, s)
+				}
+			}()
+
+			raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc := &natConn{PacketConn: raw}
+			c, err := NewConn(l.Addr().String(), tt.block, 0, 0, rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetNoDelay(1, 10, 2, 1)
+			echo := func() error {
+				c.Write([]byte("ping"))
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := io.ReadFull(c, make([]byte, 4))
+				return err
+			}
+			if err := echo(); err != nil {
+				t.Fatal(err)
+			}
+			s := <-accepted
+			before := s.RemoteAddr().String()
+
+			rc.rebind(t)
+			err = echo()
+			after := s.RemoteAddr().String()
+			if migrated := after != before; migrated != tt.migrate {
+				t.Fatalf("migrated %v, want %v: %v -> %v", migrated, tt.migrate, before, after)
+			}
+			if tt.migrate && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// the path MTU is searched again and the listener rekeys the session only on
+// a path not known before, a multipath client alternates between known ones
+func TestKnownPaths(t *testing.T) {
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	addr := func(port int) net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port} }
+	s := newUDPSession(1, 0, 0, nil, nil, raw, addr(1), nil)
+	defer s.Close()
+	if err := s.SetPMTUDiscovery(true); err != nil {
+		t.Skip("SetPMTUDiscovery:", err)
+	}
+
+	migrate := func(port int) (restarted bool, learned, forgotten []string) {
+		s.mu.Lock()
+		s.pmtu.converged = true
+		s.migrate(addr(port), raw)
+		restarted = !s.pmtu.converged
+		s.mu.Unlock()
+		learned, forgotten = s.pathChanges()
+		return
+	}
+
+	if restarted, learned, forgotten := migrate(2); !restarted || len(learned) != 1 || forgotten != nil {
+		t.Fatal("new path:", restarted, learned, forgotten)
+	}
+	for _, port := range []int{1, 2, 1, 2} {
+		if restarted, learned, forgotten := migrate(port); restarted || learned != nil || forgotten != nil {
+			t.Fatal("known path:", port, restarted, learned, forgotten)
+		}
+	}
+
+	// the oldest path is forgotten beyond maxKnownPaths
+	for port := 3; port <= maxKnownPaths; port++ {
+		migrate(port)
+	}
+	restarted, learned, forgotten := migrate(maxKnownPaths + 1)
+	if !restarted || len(learned) != 1 || len(forgotten) != 1 || forgotten[0] != addr(1).String() {
+		t.Fatal("path beyond the limit:", restarted, learned, forgotten)
+	}
+	if restarted, _, _ := migrate(1); !restarted {
+		t.Fatal("forgotten path still known")
+	}
+}
+
+// a client takes packets in the clear from its remote only, while those of
+// an authenticated session may come from anywhere
+func TestClientSource(t *testing.T) {
+	salsa20, _ := NewSalsa20BlockCrypt(make([]byte, 32))
+	tests := []struct {
+		name  string
+		block BlockCrypt
+		from  int // 0 for the remote, 1 for another host
+		taken bool
+	}{
+		{"remote", nil, 0, true},
+		{"spoofed", nil, 1, false},
+		{"spoofed salsa20", salsa20, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hosts [2]net.PacketConn
+			for k := range hosts {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				hosts[k] = conn
+			}
+			raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newUDPSession(1, 0, 0, nil, nil, raw, hosts[0].LocalAddr(), tt.block)
+			defer s.Close()
+
+			peer := newUDPSession(1, 0, 0, nil, nil, hosts[tt.from], raw.LocalAddr(), tt.block)
+			defer peer.Close()
+			peer.Write([]byte("hello"))
+
+			s.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, 16)
+			_, err = s.Read(buf)
+			if taken := err == nil; taken != tt.taken {
+				t.Fatal("taken:", taken, err)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package kcp
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -20,7 +23,12 @@ type errTimeout struct {
 
 func (errTimeout) Timeout() bool   { return true }
 func (errTimeout) Temporary() bool { return true }
-func (errTimeout) Error() string   { return "i/o timeout" }
+func (e errTimeout) Error() string {
+	if e.error != nil {
+		return e.error.Error()
+	}
+	return "i/o timeout"
+}
 
 const (
 	// 16-bytes nonce for each packet
@@ -32,23 +40,88 @@ const (
 	// overall crypto header size
 	cryptHeaderSize = nonceSize + crcSize
 
-	// maximum packet size
-	mtuLimit = 1500
+	// the largest UDP payload
+	maxMtuLimit = 65507
 
 	// accept backlog
 	acceptBacklog = 128
+
+	// the update interval of an idle session, which is woken up at once
+	// when there's something to send or acknowledge
+	idleInterval = 10 * time.Second
+
+	// FEC keeps rxFECMulti* (dataShard+parityShard) ordered packets in memory
+	rxFECMulti = 3
+
+	// interval for sampling the loss rate of adaptive FEC
+	fecAdaptInterval = time.Second
+
+	// a new path of a session is challenged once nothing has been received
+	// from the remote address for an interval, at most once per interval
+	challengeInterval = 500 * time.Millisecond
+
+	// the paths a session remembers, the oldest is forgotten beyond
+	maxKnownPaths = 8
 )
 
 var (
 	errBrokenPipe       = errors.New("broken pipe")
 	errInvalidOperation = errors.New("invalid operation")
+
+	// ErrDeadLink is returned by Read/Write after the session has been
+	// closed because a segment reached the dead link retransmission limit
+	ErrDeadLink = errors.New("dead link")
+
+	// ErrIdleTimeout is returned by Read/Write after the session has been
+	// closed because nothing was received for the idle timeout, it's a
+	// net.Error with Timeout() true
+	ErrIdleTimeout net.Error = errTimeout{errors.New("idle timeout")}
+
+	// ErrMessageTooLarge is returned by WriteMessage for a message larger
+	// than MaxMessageSize
+	ErrMessageTooLarge = errors.New("message too large")
 )
 
 var (
+	// maximum packet size, it sizes every packet buffer
+	mtuLimit = 1500
+
+	// mtuLimit is fixed once the first packet buffers are sized by it
+	mtuLimitLock sync.Mutex
+	mtuLimitUsed int32
+
 	// to mitigate high-frequency memory allocation for packets
 	xmitBuf sync.Pool
 )
 
+// SetMTULimit sets the maximum packet size of all sessions and listeners, up
+// to the largest UDP payload, allowing jumbo frames. As it sizes the packet
+// buffers, it fails once any session, listener, dialer or multipath connection
+// has been created.
+func SetMTULimit(limit int) error {
+	if limit < IKCP_MTU_DEF || limit > maxMtuLimit {
+		return errors.Errorf("mtu limit %v out of range [%v, %v]", limit, IKCP_MTU_DEF, maxMtuLimit)
+	}
+	mtuLimitLock.Lock()
+	defer mtuLimitLock.Unlock()
+	if mtuLimitUsed != 0 {
+		return errors.New("mtu limit set after the packet buffers were sized")
+	}
+	mtuLimit = limit
+	return nil
+}
+
+// useMTULimit fixes mtuLimit before sizing packet buffers by it, every
+// constructor reading it calls this first
+func useMTULimit() {
+	if atomic.LoadInt32(&mtuLimitUsed) != 0 {
+		return
+	}
+	mtuLimitLock.Lock()
+	atomic.StoreInt32(&mtuLimitUsed, 1)
+	mtuLimitLock.Unlock()
+}
+
 func init() {
 	xmitBuf.New = func() interface{} {
 		return make([]byte, mtuLimit)
@@ -58,11 +131,16 @@ func init() {
 type (
 	// UDPSession defines a KCP session implemented by UDP
 	UDPSession struct {
-		updaterIdx int            // record slice index in updater
-		conn       net.PacketConn // the underlying packet connection
-		kcp        *KCP           // KCP ARQ protocol
-		l          *Listener      // pointing to the Listener object if it's been accepted by a Listener
-		block      BlockCrypt     // block encryption object
+		conn    net.PacketConn // the underlying packet connection
+		kcp     *KCP           // KCP ARQ protocol
+		l       *Listener      // pointing to the Listener object if it's been accepted by a Listener
+		d       *Dialer        // pointing to the Dialer object if it shares the connection of a Dialer
+		block   BlockCrypt     // block encryption object
+		clock   Clock          // time source of the timers, from the connection if it provides one
+		updater *updater       // the updater calling update() on the clock
+		wheel   *timerWheel    // the shard of the updater the session is assigned to
+		timer   wheelEntry     // the position in the wheel, guarded by the wheel
+		idle    bool           // scheduled at the idle interval
 
 		// kcp receiving is based on packets
 		// recvbuf turns packets into stream
@@ -71,6 +149,51 @@ type (
 		// header extended output buffer, if has header
 		ext []byte
 
+		// packets waiting to be written in batch at the end of a flush
+		txqueue         []ipv4.Message
+		xconn           batchConn // for batched I/O, nil if not supported
+		xconnWriteError error
+
+		// FEC codec
+		fecDecoder  *fecDecoder
+		fecDecLock  sync.Mutex // packets of a known path may arrive on another conn
+		fecEncoder  *fecEncoder
+		fecAdaptive bool      // adapt parity shards to the measured loss rate
+		fecAdaptTs  time.Time // last time the loss rate was sampled
+
+		// path mtu discovery, nil if disabled
+		pmtu *pmtuProber
+
+		// the new path challenged to echo before migrating without progress
+		remoteTs      time.Time // last time a packet was received from the remote address
+		challenge     []byte
+		challengeAddr net.Addr
+		challengeConn net.PacketConn
+		challengeTs   time.Time
+
+		// the paths the remote has been reached over, oldest first, a
+		// multipath client alternates between them
+		paths          []path
+		pathsLearned   []string // the addresses of the paths learned and forgotten,
+		pathsForgotten []string // since the listener has last rekeyed the session
+
+		// liveness
+		keepAlive   time.Duration // interval of the keepalives, 0 to disable
+		keepAliveTs time.Time     // last time a keepalive was sent
+		idleTimeout time.Duration // closes the session after receiving nothing for this long, 0 to disable
+		recvTs      time.Time     // last time a packet was received, while the idle timeout is set
+
+		// orderly shutdown
+		finSent        bool          // the writing side has been shut down by a FIN
+		linger         time.Duration // how long Close keeps sending the queued data, 0 to discard it
+		lingering      bool          // closed, sending the queued data until lingerDeadline
+		lingerDeadline time.Time     // zero to linger until all the data has been acknowledged
+
+		// pacing
+		pacer     *pacer // created on first use, drained by pace()
+		pacing    bool   // spread the packets of a flush over the flush interval
+		rateLimit uint64 // send rate limit in bytes per second, 0 for unlimited
+
 		// settings
 		remote     net.Addr  // remote peer address
 		rd         time.Time // read deadline
@@ -82,7 +205,9 @@ type (
 
 		// notifications
 		die          chan struct{} // notify current session has Closed
+		dead         chan struct{} // notify current session has stopped sending, after lingering
 		chReadEvent  chan struct{} // notify Read() can be called without blocking
+		chDgramEvent chan struct{} // notify ReceiveDatagram() can be called without blocking
 		chWriteEvent chan struct{} // notify Write() can be called without blocking
 		chReadError  chan error    // notify PacketConn.Read() have an error
 		chWriteError chan error    // notify PacketConn.Write() have an error
@@ -90,7 +215,11 @@ type (
 		// nonce generator
 		nonce nonceMD5
 
-		isClosed bool // flag the session has Closed
+		// bytes read and written by the application
+		bytesSent, bytesReceived uint64
+
+		isClosed bool  // flag the session has Closed
+		closeErr error // the error returned by Read/Write once closed
 		mu       sync.Mutex
 	}
 
@@ -105,26 +234,67 @@ type (
 	setDSCP interface {
 		SetDSCP(int) error
 	}
+
+	clockConn interface {
+		Clock() Clock
+	}
 )
 
+// connClock returns the clock of a connection, SystemClock if it has none
+func connClock(conn net.PacketConn) Clock {
+	if c, ok := conn.(clockConn); ok {
+		return c.Clock()
+	}
+	return SystemClock
+}
+
 // newUDPSession create a new udp session for client or server
-func newUDPSession(conv uint32, l *Listener, conn net.PacketConn, remote net.Addr, block BlockCrypt) *UDPSession {
+func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, d *Dialer, conn net.PacketConn, remote net.Addr, block BlockCrypt) *UDPSession {
+	useMTULimit()
 	sess := new(UDPSession)
 	sess.die = make(chan struct{})
+	sess.dead = make(chan struct{})
 	sess.chReadEvent = make(chan struct{}, 1)
+	sess.chDgramEvent = make(chan struct{}, 1)
 	sess.chWriteEvent = make(chan struct{}, 1)
 	sess.chReadError = make(chan error, 1)
 	sess.chWriteError = make(chan error, 1)
 	sess.remote = remote
+	sess.paths = []path{{remote.String(), conn}}
 	sess.conn = conn
 	sess.l = l
+	sess.d = d
 	sess.block = block
 	sess.recvbuf = make([]byte, mtuLimit)
 
-	// calculate additional header size introduced by encryption
+	// the clock of the connection if it provides one, sessions on a
+	// ManualClock are updated by its Advance rather than the global updater
+	sess.clock = connClock(conn)
+	sess.updater = defaultUpdater
+	if mc, ok := sess.clock.(*ManualClock); ok {
+		sess.updater = mc.updater
+	}
+
+	// batched I/O is only available on a plain UDP connection
+	if _, ok := conn.(*net.UDPConn); ok {
+		sess.xconn = newBatchConn(conn)
+	}
+
+	// FEC codec initialization
+	sess.fecDecoder = newFECDecoder(rxFECMulti*(dataShards+parityShards), dataShards, parityShards)
+	if sess.block != nil {
+		sess.fecEncoder = newFECEncoder(dataShards, parityShards, cryptHeaderSize)
+	} else {
+		sess.fecEncoder = newFECEncoder(dataShards, parityShards, 0)
+	}
+
+	// calculate additional header size introduced by FEC and encryption
 	if sess.block != nil {
 		sess.headerSize += cryptHeaderSize
 	}
+	if sess.fecEncoder != nil {
+		sess.headerSize += fecHeaderSizePlus2
+	}
 
 	// we only need to allocate extended packet buffer if we have the additional header
 	if sess.headerSize > 0 {
@@ -137,38 +307,71 @@ func newUDPSession(conv uint32, l *Listener, conn net.PacketConn, remote net.Add
 		}
 	})
 	sess.kcp.SetMtu(IKCP_MTU_DEF - sess.headerSize)
+	sess.kcp.SetClock(sess.clock)
 
-	// register current session to the global updater,
+	// register current session to the updater of its clock,
 	// which call sess.update() periodically.
-	updater.addSession(sess)
+	sess.updater.addSession(sess)
 
 	if sess.l == nil { // it's a client connection
-		go sess.readLoop()
+		if sess.d == nil { // the dialer reads a shared connection
+			go sess.readLoop()
+		}
+		atomic.AddUint64(&DefaultSnmp.ActiveOpens, 1)
+	} else {
+		atomic.AddUint64(&DefaultSnmp.PassiveOpens, 1)
+	}
+
+	currestab := atomic.AddUint64(&DefaultSnmp.CurrEstab, 1)
+	maxconn := atomic.LoadUint64(&DefaultSnmp.MaxConn)
+	if currestab > maxconn {
+		atomic.CompareAndSwapUint64(&DefaultSnmp.MaxConn, maxconn, currestab)
 	}
 
 	return sess
 }
 
 // Read implements net.Conn
-func (s *UDPSession) Read(b []byte) (n int, err error) {
+func (s *UDPSession) Read(b []byte) (n int, err error) { return s.read(b, false) }
+
+// ReadMessage reads a whole message sent by WriteMessage, or by a Write in
+// message mode. It returns io.ErrShortBuffer if 'b' can't hold the next
+// message, which is kept to be read with a larger buffer, a buffer of
+// MaxMessageSize bytes holds any message. The rest of a message partially
+// read by Read is returned first.
+func (s *UDPSession) ReadMessage(b []byte) (n int, err error) { return s.read(b, true) }
+
+// read receives into 'b', a message at once in message mode, otherwise a
+// message larger than 'b' is kept in recvbuf for the following reads
+func (s *UDPSession) read(b []byte, message bool) (n int, err error) {
 	for {
 		s.mu.Lock()
 		if len(s.bufptr) > 0 { // copy from buffer into b
 			n = copy(b, s.bufptr)
 			s.bufptr = s.bufptr[n:]
+			s.bytesReceived += uint64(n)
 			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
 			return n, nil
 		}
 
 		if s.isClosed {
 			s.mu.Unlock()
-			return 0, errBrokenPipe
+			return 0, s.closeErr
 		}
 
 		if size := s.kcp.PeekSize(); size > 0 { // peek data size from kcp
+			if message && len(b) < size {
+				s.mu.Unlock()
+				return 0, io.ErrShortBuffer
+			}
+
 			if len(b) >= size { // receive data into 'b' directly
 				s.kcp.Recv(b)
+				s.wakeIdle() // to tell the remote the window has opened
+				s.bytesReceived += uint64(size)
 				s.mu.Unlock()
+				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(size))
 				return size, nil
 			}
 
@@ -180,24 +383,32 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 			// resize the length of recvbuf to correspond to data size
 			s.recvbuf = s.recvbuf[:size]
 			s.kcp.Recv(s.recvbuf)
+			s.wakeIdle()
 			n = copy(b, s.recvbuf)   // copy to 'b'
 			s.bufptr = s.recvbuf[n:] // pointer update
+			s.bytesReceived += uint64(n)
 			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
 			return n, nil
 		}
 
+		// the remote has shut down its writing side
+		if s.kcp.FinReceived() {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
 		// deadline for current reading operation
-		var timeout *time.Timer
-		var c <-chan time.Time
+		var timeout func() bool
+		var c <-chan struct{}
 		if !s.rd.IsZero() {
-			if time.Now().After(s.rd) {
+			now := s.clock.Now()
+			if now.After(s.rd) {
 				s.mu.Unlock()
 				return 0, errTimeout{}
 			}
 
-			delay := s.rd.Sub(time.Now())
-			timeout = time.NewTimer(delay)
-			c = timeout.C
+			c, timeout = after(s.clock, s.rd.Sub(now))
 		}
 		s.mu.Unlock()
 
@@ -208,59 +419,100 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 		case <-s.die:
 		case err = <-s.chReadError:
 			if timeout != nil {
-				timeout.Stop()
+				timeout()
 			}
 			return n, err
 		}
 
 		if timeout != nil {
-			timeout.Stop()
+			timeout()
 		}
 	}
 }
 
 // Write implements net.Conn
-func (s *UDPSession) Write(b []byte) (n int, err error) {
+func (s *UDPSession) Write(b []byte) (n int, err error) { return s.write(b, false) }
+
+// WriteMessage sends 'b' as a single message, to be read at once by
+// ReadMessage on the remote. It returns ErrMessageTooLarge if 'b' is larger
+// than MaxMessageSize, and errors in stream mode or on an empty message.
+func (s *UDPSession) WriteMessage(b []byte) (n int, err error) { return s.write(b, true) }
+
+// MaxMessageSize returns the largest message WriteMessage accepts, which
+// is 255 segments of the current MTU. A message is only delivered if the
+// receive window of the remote holds all its segments.
+func (s *UDPSession) MaxMessageSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxMessageSize()
+}
+
+func (s *UDPSession) maxMessageSize() int { return maxFragments * int(s.kcp.mss) }
+
+// write sends 'b' as a single message in message mode, otherwise as the
+// messages of 'b' split by mss, or appended to the stream
+func (s *UDPSession) write(b []byte, message bool) (n int, err error) {
 	for {
 		s.mu.Lock()
 		if s.isClosed {
+			s.mu.Unlock()
+			return 0, s.closeErr
+		}
+		if s.finSent {
 			s.mu.Unlock()
 			return 0, errBrokenPipe
 		}
 
+		if message {
+			if s.kcp.stream != 0 || len(b) == 0 {
+				s.mu.Unlock()
+				return 0, errInvalidOperation
+			}
+			if len(b) > s.maxMessageSize() {
+				s.mu.Unlock()
+				return 0, ErrMessageTooLarge
+			}
+		}
+
 		// controls how much data will be sent to kcp core
 		// to prevent the memory from exhuasting
 		if s.kcp.WaitSnd() < int(s.kcp.snd_wnd) {
 			n = len(b)
-			for {
-				if len(b) <= int(s.kcp.mss) {
-					s.kcp.Send(b)
-					break
-				} else {
-					s.kcp.Send(b[:s.kcp.mss])
-					b = b[s.kcp.mss:]
+			if message {
+				s.kcp.Send(b)
+			} else {
+				for {
+					if len(b) <= int(s.kcp.mss) {
+						s.kcp.Send(b)
+						break
+					} else {
+						s.kcp.Send(b[:s.kcp.mss])
+						b = b[s.kcp.mss:]
+					}
 				}
 			}
 
 			// flush immediately if the queue is full
 			if s.kcp.WaitSnd() >= int(s.kcp.snd_wnd) || !s.writeDelay {
-				s.kcp.flush(false)
+				s.flush()
 			}
+			s.wakeIdle()
+			s.bytesSent += uint64(n)
 			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
 			return n, nil
 		}
 
 		// deadline for current writing operation
-		var timeout *time.Timer
-		var c <-chan time.Time
+		var timeout func() bool
+		var c <-chan struct{}
 		if !s.wd.IsZero() {
-			if time.Now().After(s.wd) {
+			now := s.clock.Now()
+			if now.After(s.wd) {
 				s.mu.Unlock()
 				return 0, errTimeout{}
 			}
-			delay := s.wd.Sub(time.Now())
-			timeout = time.NewTimer(delay)
-			c = timeout.C
+			c, timeout = after(s.clock, s.wd.Sub(now))
 		}
 		s.mu.Unlock()
 
@@ -271,43 +523,234 @@ func (s *UDPSession) Write(b []byte) (n int, err error) {
 		case <-s.die:
 		case err = <-s.chWriteError:
 			if timeout != nil {
-				timeout.Stop()
+				timeout()
 			}
 			return n, err
 		}
 
 		if timeout != nil {
-			timeout.Stop()
+			timeout()
 		}
 	}
 }
 
-// Close closes the connection.
-func (s *UDPSession) Close() error {
-	// remove current session from updater & listener(if necessary)
-	updater.removeSession(s)
-	if s.l != nil { // notify listener
-		s.l.closeSession(s.remote)
+// SendDatagram sends 'b' as an unreliable datagram, which is never
+// retransmitted, and may be lost, duplicated or reordered. It shares the
+// encryption, the FEC and the congestion window of the session, and is sent
+// ahead of the reliable data in the room left in the window. It doesn't
+// block, the oldest datagrams are dropped if they can't be sent fast enough.
+//
+// It returns ErrMessageTooLarge if 'b' is larger than MaxDatagramSize.
+func (s *UDPSession) SendDatagram(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return s.closeErr
+	}
+	if s.finSent {
+		return errBrokenPipe
+	}
+	if len(b) == 0 {
+		return errInvalidOperation
+	}
+	if s.kcp.SendDatagram(b) != 0 {
+		return ErrMessageTooLarge
+	}
+	if !s.writeDelay {
+		s.flush()
+	}
+	s.wakeIdle()
+	s.bytesSent += uint64(len(b))
+	atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(len(b)))
+	return nil
+}
+
+// ReceiveDatagram waits for a datagram sent by SendDatagram on the remote,
+// and reads it into 'b'. It returns io.ErrShortBuffer if 'b' can't hold the
+// datagram, which is kept to be read with a larger buffer. The datagrams
+// received while the application is not reading are kept up to the receive
+// window, the oldest ones are dropped beyond that.
+func (s *UDPSession) ReceiveDatagram(b []byte) (n int, err error) {
+	for {
+		s.mu.Lock()
+		if n = s.kcp.RecvDatagram(b); n >= 0 {
+			s.bytesReceived += uint64(n)
+			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			return n, nil
+		} else if n == -3 {
+			s.mu.Unlock()
+			return 0, io.ErrShortBuffer
+		}
+
+		if s.isClosed {
+			s.mu.Unlock()
+			return 0, s.closeErr
+		}
+
+		// deadline for current reading operation
+		var timeout func() bool
+		var c <-chan struct{}
+		if !s.rd.IsZero() {
+			now := s.clock.Now()
+			if now.After(s.rd) {
+				s.mu.Unlock()
+				return 0, errTimeout{}
+			}
+
+			c, timeout = after(s.clock, s.rd.Sub(now))
+		}
+		s.mu.Unlock()
+
+		// wait for datagram event or timeout
+		select {
+		case <-s.chDgramEvent:
+		case <-c:
+		case <-s.die:
+		case err = <-s.chReadError:
+			if timeout != nil {
+				timeout()
+			}
+			return 0, err
+		}
+
+		if timeout != nil {
+			timeout()
+		}
 	}
+}
+
+// MaxDatagramSize returns the largest datagram SendDatagram accepts, a
+// datagram is sent in a single segment of the current MTU
+func (s *UDPSession) MaxDatagramSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.kcp.mss)
+}
+
+// flush sends the queued data at once, the caller must hold s.mu
+func (s *UDPSession) flush() {
+	s.kcp.flush(false)
+	s.uncork()
+	if s.pacer != nil {
+		s.pacer.setRate(s.pacingRate(), s.rateLimit)
+	}
+}
 
+// CloseWrite shuts down the writing side of the session, a FIN is sent after
+// the data written so far, and the remote reads io.EOF once it has received
+// all of it. Write fails afterwards, while Read keeps working.
+func (s *UDPSession) CloseWrite() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.isClosed {
+		return s.closeErr
+	}
+	s.sendFin()
+	return nil
+}
+
+// sendFin queues a FIN once and sends it, the caller must hold s.mu
+func (s *UDPSession) sendFin() {
+	if !s.finSent {
+		s.finSent = true
+		s.kcp.SendFin()
+		s.flush()
+		s.wakeIdle()
+	}
+}
+
+// SetLinger sets how long Close keeps sending the data queued, after Read and
+// Write have returned, until the remote has acknowledged all of it and the
+// FIN. With 0, the default, the data not acknowledged yet is discarded on
+// Close, and a FIN is only sent if there's none.
+func (s *UDPSession) SetLinger(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linger = d
+}
+
+// Close closes the connection.
+func (s *UDPSession) Close() error { return s.close(false) }
+
+// close closes the session, with 'drain' it lingers until all the data has
+// been acknowledged, regardless of the linger setting
+func (s *UDPSession) close(drain bool) error {
+	s.mu.Lock()
+	if s.isClosed {
+		s.mu.Unlock()
 		return errBrokenPipe
 	}
 	close(s.die)
 	s.isClosed = true
-	if s.l == nil { // client socket close
+
+	// a session closed on dead link or idle timeout doesn't linger
+	if s.closeErr == nil {
+		s.closeErr = errBrokenPipe
+		if s.linger > 0 || drain {
+			s.sendFin()
+			s.lingering = true
+			s.lingerDeadline = time.Time{}
+			if !drain {
+				s.lingerDeadline = s.clock.Now().Add(s.linger)
+			}
+			s.reschedule()
+			s.mu.Unlock()
+			return nil
+		} else if s.kcp.WaitSnd() == 0 { // the FIN has a chance if it's all sent
+			s.sendFin()
+		}
+	}
+	s.mu.Unlock()
+	return s.stop()
+}
+
+// abort stops a session lingering at once
+func (s *UDPSession) abort() {
+	s.mu.Lock()
+	lingering := s.lingering
+	s.lingering = false
+	s.mu.Unlock()
+	if lingering {
+		s.stop()
+	}
+}
+
+// stop removes the session from the updater and the listener, once it has
+// stopped sending
+func (s *UDPSession) stop() error {
+	// remove current session from updater & listener(if necessary)
+	s.updater.removeSession(s)
+	if s.l != nil { // notify listener
+		s.l.closeSession(s)
+	}
+	if s.d != nil { // notify dialer
+		s.d.closeSession(s)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.dead)
+	atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+	if s.l == nil && s.d == nil { // client socket close
 		return s.conn.Close()
 	}
 	return nil
 }
 
 // LocalAddr returns the local network address. The Addr returned is shared by all invocations of LocalAddr, so do not modify it.
-func (s *UDPSession) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+func (s *UDPSession) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.LocalAddr()
+}
 
 // RemoteAddr returns the remote network address. The Addr returned is shared by all invocations of RemoteAddr, so do not modify it.
-func (s *UDPSession) RemoteAddr() net.Addr { return s.remote }
+func (s *UDPSession) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
 
 // SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
 func (s *UDPSession) SetDeadline(t time.Time) error {
@@ -316,6 +759,7 @@ func (s *UDPSession) SetDeadline(t time.Time) error {
 	s.rd = t
 	s.wd = t
 	s.notifyReadEvent()
+	s.notifyDgramEvent()
 	s.notifyWriteEvent()
 	return nil
 }
@@ -326,6 +770,7 @@ func (s *UDPSession) SetReadDeadline(t time.Time) error {
 	defer s.mu.Unlock()
 	s.rd = t
 	s.notifyReadEvent()
+	s.notifyDgramEvent()
 	return nil
 }
 
@@ -389,6 +834,138 @@ func (s *UDPSession) SetDUP(dup int) {
 	s.dup = dup
 }
 
+// SetFECAdaptive toggles adapting the number of parity shards sent to the
+// measured loss rate, the configured parityShards is used as the upper bound.
+// It has no effect if FEC is disabled.
+func (s *UDPSession) SetFECAdaptive(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fecEncoder == nil {
+		return
+	}
+	s.fecAdaptive = enable
+	if !enable {
+		s.fecEncoder.activeParity = s.fecEncoder.parityShards
+	}
+}
+
+// SetDeadLink sets the number of transmissions of a single segment after
+// which the link is considered dead and the session is closed, 0 to disable
+func (s *UDPSession) SetDeadLink(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > 0 {
+		s.kcp.dead_link = uint32(n)
+	} else {
+		s.kcp.dead_link = 0xFFFFFFFF
+	}
+}
+
+// SetKeepAlive sends a keepalive to the remote every 'interval', so that the
+// remote's idle timeout doesn't expire while the session has nothing to send,
+// 0 to disable
+func (s *UDPSession) SetKeepAlive(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepAlive = interval
+	s.keepAliveTs = s.clock.Now()
+	s.reschedule()
+}
+
+// SetIdleTimeout closes the session once nothing has been received from the
+// remote for 'd', the pending and later Read/Write return ErrIdleTimeout.
+// 0 to disable. The remote is expected to send keepalives at a shorter
+// interval if the session may be idle for long.
+func (s *UDPSession) SetIdleTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idleTimeout = d
+	s.recvTs = s.clock.Now()
+	s.reschedule()
+}
+
+// SetPacing toggles pacing, the packets of a flush are spread over the flush
+// interval, or sent at the pacing rate of the congestion controller if it
+// implements PacingRater, instead of being written to the socket in a burst
+func (s *UDPSession) SetPacing(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pacing = enable
+	if enable {
+		s.startPacer()
+	}
+}
+
+// SetRateLimit limits the send rate of the session in bytes per second,
+// including all headers above UDP, 0 for unlimited. Packets exceeding the
+// rate are queued for up to 100ms, and dropped beyond that.
+func (s *UDPSession) SetRateLimit(bytesPerSec int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytesPerSec > 0 {
+		s.rateLimit = uint64(bytesPerSec)
+	} else {
+		s.rateLimit = 0
+	}
+	if s.rateLimit > 0 {
+		s.startPacer()
+	}
+	if s.pacer != nil {
+		s.pacer.setRate(s.pacingRate(), s.rateLimit)
+		s.updateRateWindow()
+	}
+}
+
+// startPacer creates the pacer and its sending goroutine on first use
+func (s *UDPSession) startPacer() {
+	if s.pacer == nil {
+		s.pacer = newPacer(s.clock.Now())
+		go s.pace()
+	}
+}
+
+// updateRateWindow limits the KCP window to the bandwidth-delay product at
+// the rate limit, so that KCP doesn't keep more packets in flight than the
+// pacer is able to send
+func (s *UDPSession) updateRateWindow() {
+	if s.rateLimit == 0 {
+		s.kcp.rate_wnd = 0
+		return
+	}
+	rtt := uint64(s.kcp.rx_srtt)
+	if rtt == 0 {
+		rtt = IKCP_RTO_DEF
+	}
+	wnd := s.rateLimit * (rtt + uint64(s.kcp.interval)) / 1000 / uint64(s.kcp.mtu)
+	if wnd < IKCP_THRESH_MIN {
+		wnd = IKCP_THRESH_MIN
+	}
+	if wnd > 0xFFFF {
+		wnd = 0xFFFF
+	}
+	s.kcp.rate_wnd = uint32(wnd)
+}
+
+// pacingRate returns the rate the pacer should send at in bytes per second,
+// the lower of the rate limit and the estimated rate, 0 for unlimited
+func (s *UDPSession) pacingRate() uint64 {
+	var estimated uint64
+	if s.pacing {
+		if pr, ok := s.kcp.cc.(PacingRater); ok && s.kcp.nocwnd == 0 {
+			estimated = pr.PacingRate()
+		}
+		if estimated == 0 && s.kcp.interval > 0 { // spread the backlog over the flush interval
+			estimated = uint64(s.pacer.backlog()) * 1000 / uint64(s.kcp.interval)
+		}
+	}
+
+	rate := s.rateLimit
+	if estimated > 0 && (rate == 0 || estimated < rate) {
+		rate = estimated
+	}
+	return rate
+}
+
 // SetNoDelay calls nodelay() of kcp
 // https://github.com/skywind3000/kcp/blob/master/README.en.md#protocol-configuration
 func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
@@ -397,45 +974,35 @@ func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
 	s.kcp.NoDelay(nodelay, interval, resend, nc)
 }
 
+// SetCongestionController replaces the congestion control algorithm, it has
+// no effect while congestion control is turned off by SetNoDelay
+func (s *UDPSession) SetCongestionController(cc CongestionController) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.cc = cc
+}
+
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
 //
 // if the underlying connection has implemented `func SetDSCP(int) error`, SetDSCP() will invoke
 // this function instead.
 //
-// It has no effect if it's accepted from Listener.
+// It has no effect if it's accepted from Listener or dialed by a Dialer.
 func (s *UDPSession) SetDSCP(dscp int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.l != nil {
+	if s.l != nil || s.d != nil {
 		return errInvalidOperation
 	}
-
-	// interface enabled
-	if ts, ok := s.conn.(setDSCP); ok {
-		return ts.SetDSCP(dscp)
-	}
-
-	if nc, ok := s.conn.(net.Conn); ok {
-		var succeed bool
-		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
-			succeed = true
-		}
-		if err := ipv6.NewConn(nc).SetTrafficClass(dscp); err == nil {
-			succeed = true
-		}
-
-		if succeed {
-			return nil
-		}
-	}
-	return errInvalidOperation
+	return setConnDSCP(s.conn, dscp)
 }
 
 // SetReadBuffer sets the socket read buffer, no effect if it's accepted from Listener
+// or dialed by a Dialer
 func (s *UDPSession) SetReadBuffer(bytes int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.l == nil {
+	if s.l == nil && s.d == nil {
 		if nc, ok := s.conn.(setReadBuffer); ok {
 			return nc.SetReadBuffer(bytes)
 		}
@@ -444,10 +1011,11 @@ func (s *UDPSession) SetReadBuffer(bytes int) error {
 }
 
 // SetWriteBuffer sets the socket write buffer, no effect if it's accepted from Listener
+// or dialed by a Dialer
 func (s *UDPSession) SetWriteBuffer(bytes int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.l == nil {
+	if s.l == nil && s.d == nil {
 		if nc, ok := s.conn.(setWriteBuffer); ok {
 			return nc.SetWriteBuffer(bytes)
 		}
@@ -458,9 +1026,10 @@ func (s *UDPSession) SetWriteBuffer(bytes int) error {
 // post-processing for sending a packet from kcp core
 // steps:
 // 1. Header extending
-// 2. CRC32 integrity
-// 3. Encryption
-// 4. WriteTo kernel
+// 2. FEC encoding
+// 3. CRC32 integrity
+// 4. Encryption
+// 5. TxQueue, written to kernel in batch by uncork()
 func (s *UDPSession) output(buf []byte) {
 	var ecc [][]byte
 
@@ -471,39 +1040,106 @@ func (s *UDPSession) output(buf []byte) {
 		copy(ext[s.headerSize:], buf)
 	}
 
-	// 2&3. crc32 & encryption
+	// 2. FEC encoding
+	if s.fecEncoder != nil {
+		ecc = s.fecEncoder.encode(ext)
+	}
+
+	// 3&4. crc32 & encryption
 	if s.block != nil {
-		s.nonce.Fill(ext[:nonceSize])
-		checksum := crc32.ChecksumIEEE(ext[cryptHeaderSize:])
-		binary.LittleEndian.PutUint32(ext[nonceSize:], checksum)
-		s.block.Encrypt(ext, ext)
+		s.encrypt(ext)
+		for k := range ecc {
+			s.encrypt(ecc[k])
+		}
+	}
 
+	// 5. queue for WriteTo kernel, or queue in the pacer
+	if s.pacing || s.rateLimit > 0 {
+		for i := 0; i < s.dup+1; i++ {
+			s.pacer.push(ext)
+		}
 		for k := range ecc {
-			s.nonce.Fill(ecc[k][:nonceSize])
-			checksum := crc32.ChecksumIEEE(ecc[k][cryptHeaderSize:])
-			binary.LittleEndian.PutUint32(ecc[k][nonceSize:], checksum)
-			s.block.Encrypt(ecc[k], ecc[k])
+			s.pacer.push(ecc[k])
 		}
+		return
 	}
 
-	// 4. WriteTo kernel
-	nbytes := 0
-	npkts := 0
 	for i := 0; i < s.dup+1; i++ {
-		if n, err := s.conn.WriteTo(ext, s.remote); err == nil {
-			nbytes += n
-			npkts++
-		} else {
-			s.notifyWriteError(err)
+		s.enqueue(ext)
+	}
+	for k := range ecc {
+		s.enqueue(ecc[k])
+	}
+}
+
+// encrypt fills the nonce and the crc32 of a packet, and encrypts it
+func (s *UDPSession) encrypt(b []byte) {
+	s.nonce.Fill(b[:nonceSize])
+	checksum := crc32.ChecksumIEEE(b[cryptHeaderSize:])
+	binary.LittleEndian.PutUint32(b[nonceSize:], checksum)
+	s.block.Encrypt(b, b)
+}
+
+// enqueue copies a packet into the txqueue
+func (s *UDPSession) enqueue(b []byte) {
+	bts := xmitBuf.Get().([]byte)[:len(b)]
+	copy(bts, b)
+	var msg ipv4.Message
+	msg.Buffers = [][]byte{bts}
+	msg.Addr = s.remote
+	s.txqueue = append(s.txqueue, msg)
+}
+
+// uncork writes the packets in txqueue to the socket in batch
+func (s *UDPSession) uncork() {
+	if len(s.txqueue) > 0 {
+		s.tx(s.txqueue)
+		for k := range s.txqueue {
+			xmitBuf.Put(s.txqueue[k].Buffers[0])
+			s.txqueue[k].Buffers = nil
+			s.txqueue[k].Addr = nil
 		}
+		s.txqueue = s.txqueue[:0]
 	}
+}
 
-	for k := range ecc {
-		if n, err := s.conn.WriteTo(ecc[k], s.remote); err == nil {
-			nbytes += n
-			npkts++
-		} else {
-			s.notifyWriteError(err)
+// pace writes the packets queued in the pacer to the socket
+func (s *UDPSession) pace() {
+	defer s.pacer.clear()
+	for {
+		pkt, wait := s.pacer.pop(s.clock.Now())
+		if pkt != nil {
+			s.mu.Lock()
+			conn, remote := s.conn, s.remote
+			s.mu.Unlock()
+			if n, err := conn.WriteTo(pkt, remote); err == nil {
+				atomic.AddUint64(&DefaultSnmp.OutPkts, 1)
+				atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(n))
+			} else {
+				s.notifyWriteError(err)
+			}
+			xmitBuf.Put(pkt)
+			continue
+		}
+
+		var stop func() bool
+		var c <-chan struct{}
+		if wait > 0 {
+			c, stop = after(s.clock, wait)
+		}
+
+		select {
+		case <-c:
+		case <-s.pacer.chNotify:
+		case <-s.dead:
+			if stop != nil {
+				stop()
+			}
+			return
+		}
+
+		if stop != nil {
+			stop()
 		}
 	}
 }
@@ -511,18 +1147,159 @@ func (s *UDPSession) output(buf []byte) {
 // kcp update, returns interval for next calling
 func (s *UDPSession) update() (interval time.Duration) {
 	s.mu.Lock()
+	if s.keepAlive > 0 {
+		if now := s.clock.Now(); now.Sub(s.keepAliveTs) >= s.keepAlive {
+			s.kcp.probe |= IKCP_ASK_ALIVE
+			s.keepAliveTs = now
+		}
+	}
+
 	waitsnd := s.kcp.WaitSnd()
 	interval = time.Duration(s.kcp.flush(false)) * time.Millisecond
+	s.uncork()
 	if s.kcp.WaitSnd() < waitsnd {
 		s.notifyWriteEvent()
 	}
+
+	if s.pacer != nil {
+		s.pacer.setRate(s.pacingRate(), s.rateLimit)
+		s.updateRateWindow()
+	}
+
+	// close the session on dead link, Close() has to run on its own goroutine
+	// as it locks the session we're holding
+	if s.kcp.state == 0xFFFFFFFF && s.closeErr == nil {
+		s.closeErr = ErrDeadLink
+		go s.Close()
+	}
+
+	// likewise on idle timeout
+	if s.idleTimeout > 0 && s.clock.Now().Sub(s.recvTs) >= s.idleTimeout && s.closeErr == nil {
+		s.closeErr = ErrIdleTimeout
+		go s.Close()
+	}
+
+	// a closed session lingers until all the data has been acknowledged,
+	// it's not idle meanwhile, so the deadline is checked every interval
+	if s.lingering {
+		expired := !s.lingerDeadline.IsZero() && !s.clock.Now().Before(s.lingerDeadline)
+		if s.kcp.WaitSnd() == 0 || s.kcp.state == 0xFFFFFFFF || expired {
+			s.lingering = false
+			go s.stop()
+		}
+	}
+
+	if s.pmtu != nil {
+		s.pmtuUpdate(s.clock.Now())
+	}
+
+	// sample loss rate for adaptive FEC
+	if s.fecAdaptive {
+		if now := s.clock.Now(); now.Sub(s.fecAdaptTs) >= fecAdaptInterval {
+			s.fecEncoder.adapt(s.kcp.xmitSegs, s.kcp.retransSegs)
+			s.kcp.xmitSegs, s.kcp.retransSegs = 0, 0
+			s.fecAdaptTs = now
+		}
+	}
+
+	// an idle session sleeps until there's something to do
+	s.idle = s.isIdle()
+	if s.idle {
+		interval = idleInterval
+	}
+
+	// in time for the next keepalive and the idle timeout
+	if (s.keepAlive > 0 || s.idleTimeout > 0) && s.closeErr == nil {
+		now := s.clock.Now()
+		if d := s.keepAliveTs.Add(s.keepAlive).Sub(now); s.keepAlive > 0 && d < interval {
+			interval = d
+		}
+		if d := s.recvTs.Add(s.idleTimeout).Sub(now); s.idleTimeout > 0 && d < interval {
+			interval = d
+		}
+	}
 	s.mu.Unlock()
 	return
 }
 
+// isIdle checks if the session has nothing to do on updates, that's neither
+// data to send or retransmit, nor acks or probes to send
+func (s *UDPSession) isIdle() bool {
+	return s.kcp.idle() &&
+		(s.pmtu == nil || s.pmtu.converged) &&
+		(s.pacer == nil || s.pacer.backlog() == 0)
+}
+
+// wakeIdle updates an idle session at once if it has something to do,
+// the caller must hold s.mu
+func (s *UDPSession) wakeIdle() {
+	if s.idle && !s.isIdle() {
+		s.reschedule()
+	}
+}
+
+// reschedule updates an idle session at once, for its next update to be
+// scheduled with the changed settings, the caller must hold s.mu
+func (s *UDPSession) reschedule() {
+	if s.idle {
+		s.idle = false
+		s.updater.wakeSession(s)
+	}
+}
+
 // GetConv gets conversation id of a session
 func (s *UDPSession) GetConv() uint32 { return s.kcp.conv }
 
+// SessionStats is a snapshot of the transport states of a session
+type SessionStats struct {
+	SRTT   time.Duration // smoothed round trip time
+	RTTVar time.Duration // round trip time variation
+	RTO    time.Duration // retransmission timeout
+
+	Cwnd     uint32 // congestion window in segments, 0 if congestion control is off
+	SndWnd   uint32 // local send window in segments
+	RcvWnd   uint32 // local receive window in segments
+	RmtWnd   uint32 // remote receive window in segments
+	Inflight int    // segments sent but not acknowledged yet
+	SndQueue int    // segments waiting to be sent
+	RcvQueue int    // segments received but not read yet, including out of order ones
+
+	BytesSent     uint64 // bytes written by the application
+	BytesReceived uint64 // bytes read by the application
+	SegsSent      uint64 // KCP segments sent, including retransmissions
+	SegsReceived  uint64 // KCP segments received
+	RetransSegs   uint64 // segments retransmitted
+	LostSegs      uint64 // segments retransmitted on timeout
+	RepeatSegs    uint64 // duplicate segments received
+}
+
+// Stats returns a snapshot of the transport states of the session
+func (s *UDPSession) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var st SessionStats
+	st.SRTT = time.Duration(s.kcp.rx_srtt) * time.Millisecond
+	st.RTTVar = time.Duration(s.kcp.rx_rttvar) * time.Millisecond
+	st.RTO = time.Duration(s.kcp.rx_rto) * time.Millisecond
+	if s.kcp.nocwnd == 0 {
+		st.Cwnd = s.kcp.cwnd
+	}
+	st.SndWnd = s.kcp.snd_wnd
+	st.RcvWnd = s.kcp.rcv_wnd
+	st.RmtWnd = s.kcp.rmt_wnd
+	st.Inflight = s.kcp.snd_buf.Len()
+	st.SndQueue = s.kcp.snd_queue.Len()
+	st.RcvQueue = s.kcp.rcv_queue.Len() + s.kcp.rcv_buf.Len()
+	st.BytesSent = s.bytesSent
+	st.BytesReceived = s.bytesReceived
+	st.SegsSent = s.kcp.outSegs
+	st.SegsReceived = s.kcp.inSegs
+	st.RetransSegs = s.kcp.lostSegs + s.kcp.fastRetransSegs
+	st.LostSegs = s.kcp.lostSegs
+	st.RepeatSegs = s.kcp.repeatSegs
+	return st
+}
+
 func (s *UDPSession) notifyReadEvent() {
 	select {
 	case s.chReadEvent <- struct{}{}:
@@ -530,6 +1307,13 @@ func (s *UDPSession) notifyReadEvent() {
 	}
 }
 
+func (s *UDPSession) notifyDgramEvent() {
+	select {
+	case s.chDgramEvent <- struct{}{}:
+	default:
+	}
+}
+
 func (s *UDPSession) notifyWriteEvent() {
 	select {
 	case s.chWriteEvent <- struct{}{}:
@@ -544,160 +1328,340 @@ func (s *UDPSession) notifyWriteError(err error) {
 	}
 }
 
-func (s *UDPSession) kcpInput(data []byte) {
-	var kcpInErrors uint64
+// inputMark is a snapshot of the KCP states a fresh packet advances,
+// a replayed packet leaves them unchanged
+type inputMark struct {
+	una, nxt       uint32
+	rcvbuf, sndbuf int
+}
 
-	s.mu.Lock()
-	waitsnd := s.kcp.WaitSnd()
-	if ret := s.kcp.Input(data, true, s.ackNoDelay); ret != 0 {
-		kcpInErrors++
+func (s *UDPSession) inputMark() inputMark {
+	return inputMark{s.kcp.snd_una, s.kcp.rcv_nxt, s.kcp.rcv_buf.Len(), s.kcp.snd_buf.Len()}
+}
+
+// roam migrates the session to 'from' on 'conn' if it differs from the remote
+// address and the packet just input from it has advanced the KCP states.
+// Decryption and CRC prove the sender has the key, the progress proves the
+// packet is not a replay. A packet in the clear proves nothing, so sessions
+// without a BlockCrypt or with crypt none never migrate. The session follows
+// the client to another socket of the listener, as a multipath client
+// reaches it over both UDP and TCP.
+func (s *UDPSession) roam(from net.Addr, conn net.PacketConn, mark inputMark) {
+	if from == nil || !authenticated(s.block) {
+		return
 	}
-	if n := s.kcp.PeekSize(); n > 0 {
-		s.notifyReadEvent()
+	now := s.clock.Now()
+	if from.String() == s.remote.String() && conn == s.conn {
+		s.remoteTs = now
+		return
 	}
-	if s.kcp.WaitSnd() < waitsnd {
-		s.notifyWriteEvent()
+	if s.inputMark() != mark {
+		s.migrate(from, conn)
+	} else if s.l != nil && now.Sub(s.remoteTs) >= challengeInterval {
+		s.challengePath(from, conn)
 	}
-	s.mu.Unlock()
 }
 
-// the read loop for a client session
-func (s *UDPSession) readLoop() {
-	buf := make([]byte, mtuLimit)
-	var src string
-	for {
-		if n, addr, err := s.conn.ReadFrom(buf); err == nil {
-			// make sure the packet is from the same source
-			if src == "" { // set source address
-				src = addr.String()
-			} else if addr.String() != src {
-				continue
+// path is a remote address reached over a connection
+type path struct {
+	addr string
+	conn net.PacketConn
+}
+
+// learnPath records the path to 'addr' on 'conn', it returns false if the
+// path is known already. The oldest path is forgotten beyond maxKnownPaths.
+func (s *UDPSession) learnPath(addr net.Addr, conn net.PacketConn) bool {
+	p := path{addr.String(), conn}
+	seen := false // the address on another connection
+	for _, known := range s.paths {
+		if known == p {
+			return false
+		}
+		seen = seen || known.addr == p.addr
+	}
+	if !seen {
+		s.pathsLearned = append(s.pathsLearned, p.addr)
+	}
+	s.paths = append(s.paths, p)
+
+	if len(s.paths) > maxKnownPaths {
+		old := s.paths[0]
+		s.paths = append(s.paths[:0], s.paths[1:]...)
+		for _, known := range s.paths {
+			if known.addr == old.addr {
+				return true
 			}
+		}
+		s.pathsForgotten = append(s.pathsForgotten, old.addr)
+	}
+	return true
+}
 
-			if n >= s.headerSize+IKCP_OVERHEAD {
-				data := buf[:n]
-				dataValid := false
-				if s.block != nil {
-					s.block.Decrypt(data, data)
-					data = data[nonceSize:]
-					checksum := crc32.ChecksumIEEE(data[crcSize:])
-					if checksum == binary.LittleEndian.Uint32(data) {
-						data = data[crcSize:]
-						dataValid = true
-					}
-				} else if s.block == nil {
-					dataValid = true
-				}
+// pathChanges returns the addresses of the paths learned and forgotten since
+// the last call, for the listener to route the FEC parity packets
+func (s *UDPSession) pathChanges() (learned, forgotten []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	learned, forgotten = s.pathsLearned, s.pathsForgotten
+	s.pathsLearned, s.pathsForgotten = nil, nil
+	return
+}
 
-				if dataValid {
-					s.kcpInput(data)
-				}
-			}
-		} else {
-			s.chReadError <- err
-			return
+// pathAddrs returns the addresses of the known paths
+func (s *UDPSession) pathAddrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, len(s.paths))
+	for k := range s.paths {
+		addrs[k] = s.paths[k].addr
+	}
+	return addrs
+}
+
+// migrate sends the packets of the session to 'to' on 'conn' from now on,
+// the path MTU is searched again on a path not known before
+func (s *UDPSession) migrate(to net.Addr, conn net.PacketConn) {
+	s.remote = to
+	s.remoteTs = s.clock.Now()
+	if conn != s.conn {
+		s.conn = conn
+		s.xconn = nil
+		if _, ok := conn.(*net.UDPConn); ok {
+			s.xconn = newBatchConn(conn)
 		}
+		if s.pmtu != nil {
+			setDF(conn)
+		}
+	}
+	if s.learnPath(to, conn) {
+		s.pmtuRoam()
 	}
 }
 
-type (
-	// Listener defines a server which will be waiting to accept incoming connections
-	Listener struct {
-		block BlockCrypt     // block encryption
-		conn  net.PacketConn // the underlying packet connection
-
-		sessions        map[string]*UDPSession // all sessions accepted by this Listener
-		sessionLock     sync.Mutex
-		chAccepts       chan *UDPSession // Listen() backlog
-		chSessionClosed chan net.Addr    // session close queue
-		headerSize      int              // the additional header to a KCP frame
-		die             chan struct{}    // notify the listener has closed
-		rd              atomic.Value     // read deadline for Accept()
-		wd              atomic.Value
+// challengePath asks 'from' to echo a random challenge, the session migrates
+// once it's echoed. The packets of a multipath client on a new path can't
+// advance the KCP states while the answers are lost on the path that died,
+// the challenge proves the new path without trusting a possible replay. The
+// remote address is only challenged out once it has gone silent, the paths
+// of a multipath client up all carry its small packets.
+func (s *UDPSession) challengePath(from net.Addr, conn net.PacketConn) {
+	now := s.clock.Now()
+	if now.Sub(s.challengeTs) < challengeInterval {
+		return
 	}
-)
+	s.challengeTs = now
+	s.challenge = make([]byte, multipathProbeSize)
+	io.ReadFull(rand.Reader, s.challenge)
+	s.challengeAddr = from
+	s.challengeConn = conn
+	s.l.hsEncoder.writeTo(conn, from, s.kcp.conv, IKCP_CMD_PING, s.challenge)
+}
 
-// monitor incoming data for all connections of server
-func (l *Listener) monitor() {
-	// a cache for session object last used
-	var lastAddr string
-	var lastSession *UDPSession
-	buf := make([]byte, mtuLimit)
-	for {
-		if n, from, err := l.conn.ReadFrom(buf); err == nil {
-			if n >= l.headerSize+IKCP_OVERHEAD {
-				data := buf[:n]
-				dataValid := false
-				if l.block != nil {
-					l.block.Decrypt(data, data)
-					data = data[nonceSize:]
-					checksum := crc32.ChecksumIEEE(data[crcSize:])
-					if checksum == binary.LittleEndian.Uint32(data) {
-						data = data[crcSize:]
-						dataValid = true
-					}
-				} else if l.block == nil {
-					dataValid = true
-				}
+// challengeAnswered migrates the session to 'from' on 'conn' if it has
+// echoed the challenge, it returns whether the session has migrated
+func (s *UDPSession) challengeAnswered(payload []byte, from net.Addr, conn net.PacketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.challenge == nil || conn != s.challengeConn || from.String() != s.challengeAddr.String() ||
+		!bytes.Equal(payload, s.challenge) {
+		return false
+	}
+	s.challenge = nil
+	if from.String() == s.remote.String() && conn == s.conn {
+		return false
+	}
+	s.migrate(from, conn)
+	return true
+}
 
-				if dataValid {
-					addr := from.String()
-					var s *UDPSession
-					var ok bool
+// touch records a packet has been received, for the idle timeout
+func (s *UDPSession) touch() {
+	if s.idleTimeout > 0 {
+		s.recvTs = s.clock.Now()
+	}
+}
 
-					// the packets received from an address always come in batch,
-					// cache the session for next packet, without querying map.
-					if addr == lastAddr {
-						s, ok = lastSession, true
-					} else {
-						l.sessionLock.Lock()
-						if s, ok = l.sessions[addr]; ok {
-							lastSession = s
-							lastAddr = addr
-						}
-						l.sessionLock.Unlock()
+// fromRemote reports whether a client session takes a packet from 'addr'.
+// The CRC of a packet in the clear can be forged by anyone, so an off-path
+// host guessing the conv could inject segments, such a packet is only taken
+// from the remote. A MultipathConn checks the source of each path itself.
+func (s *UDPSession) fromRemote(addr net.Addr) bool {
+	if authenticated(s.block) {
+		return true
+	}
+	if _, ok := s.conn.(*MultipathConn); ok {
+		return true
+	}
+	return addr != nil && sameAddr(addr, s.remote)
+}
+
+// kcpInput feeds a packet received from 'from' on 'conn', 'from' is nil if
+// the session is not allowed to migrate
+func (s *UDPSession) kcpInput(data []byte, from net.Addr, conn net.PacketConn) {
+	var kcpInErrors, fecErrs, fecRecovered, fecParityShards uint64
+
+	if s.fecDecoder != nil {
+		if len(data) > fecHeaderSize { // must be larger than fec header size
+			f := fecPacket(data)
+			if f.flag() == typeData || f.flag() == typeParity || f.flag() == typeRaw { // header check
+				if f.flag() == typeParity {
+					fecParityShards++
+				}
+				var recovers [][]byte
+				if f.flag() != typeRaw {
+					s.fecDecLock.Lock()
+					recovers = s.fecDecoder.decode(f)
+					s.fecDecLock.Unlock()
+				}
+
+				s.mu.Lock()
+				waitsnd := s.kcp.WaitSnd()
+				mark := s.inputMark()
+				if f.flag() == typeData || f.flag() == typeRaw {
+					if ret := s.kcp.Input(data[fecHeaderSizePlus2:], true, s.ackNoDelay); ret != 0 {
+						kcpInErrors++
 					}
-					if !ok { // new session
-						if len(l.chAccepts) < cap(l.chAccepts) { // do not let the new sessions overwhelm accept queue
-							var conv uint32
-							convValid := false
-							conv = binary.LittleEndian.Uint32(data)
-							convValid = true
-
-							if convValid { // creates a new session only if the 'conv' field in kcp is accessible
-								s := newUDPSession(conv, l, l.conn, from, l.block)
-								s.kcpInput(data)
-								l.sessionLock.Lock()
-								l.sessions[addr] = s
-								l.sessionLock.Unlock()
-								l.chAccepts <- s
+				}
+
+				for _, r := range recovers {
+					if len(r) >= 2 { // must be larger than 2bytes
+						sz := binary.LittleEndian.Uint16(r)
+						if int(sz) <= len(r) && sz >= 2 {
+							if ret := s.kcp.Input(r[2:sz], false, s.ackNoDelay); ret == 0 {
+								fecRecovered++
+							} else {
+								kcpInErrors++
 							}
+						} else {
+							fecErrs++
 						}
 					} else {
-						s.kcpInput(data)
+						fecErrs++
 					}
+					// recycle the recovers
+					xmitBuf.Put(r)
 				}
+
+				// to notify the readers to receive the data, or the end of it
+				if n := s.kcp.PeekSize(); n > 0 || s.kcp.FinReceived() {
+					s.notifyReadEvent()
+				}
+				if s.kcp.rcv_dgrams.Len() > 0 {
+					s.notifyDgramEvent()
+				}
+				// to notify the writers when queue is shorter(e.g. ACKed)
+				if s.kcp.WaitSnd() < waitsnd {
+					s.notifyWriteEvent()
+				}
+				s.roam(from, conn, mark)
+				s.touch()
+				s.wakeIdle()
+				s.uncork()
+				s.mu.Unlock()
+			} else {
+				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
 			}
 		} else {
-			return
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
 		}
+	} else {
+		s.mu.Lock()
+		waitsnd := s.kcp.WaitSnd()
+		mark := s.inputMark()
+		if ret := s.kcp.Input(data, true, s.ackNoDelay); ret != 0 {
+			kcpInErrors++
+		}
+		if n := s.kcp.PeekSize(); n > 0 || s.kcp.FinReceived() {
+			s.notifyReadEvent()
+		}
+		if s.kcp.rcv_dgrams.Len() > 0 {
+			s.notifyDgramEvent()
+		}
+		if s.kcp.WaitSnd() < waitsnd {
+			s.notifyWriteEvent()
+		}
+		s.roam(from, conn, mark)
+		s.touch()
+		s.wakeIdle()
+		s.uncork()
+		s.mu.Unlock()
+	}
+
+	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
+	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
+	if fecParityShards > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECParityShards, fecParityShards)
+	}
+	if kcpInErrors > 0 {
+		atomic.AddUint64(&DefaultSnmp.KCPInErrors, kcpInErrors)
+	}
+	if fecErrs > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECErrs, fecErrs)
+	}
+	if fecRecovered > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECRecovered, fecRecovered)
 	}
 }
 
-// SetReadBuffer sets the socket read buffer for the Listener
+type (
+	// Listener defines a server which will be waiting to accept incoming connections
+	Listener struct {
+		block        BlockCrypt       // block encryption
+		dataShards   int              // FEC data shard
+		parityShards int              // FEC parity shard
+		fecDecoder   *fecDecoder      // FEC mock initialization
+		conns        []net.PacketConn // the underlying packet connections, one per shard
+
+		sessions       map[uint32]*UDPSession // all sessions accepted by this Listener, by conv
+		sessionsByAddr map[string]*UDPSession // the latest session of an address of a known path, for FEC parity packets
+		sessionLock    sync.Mutex
+		chAccepts      chan *UDPSession // Listen() backlog
+		headerSize     int              // the additional header to a KCP frame
+		die            chan struct{}    // notify the listener has closed
+		dieOnce        sync.Once
+		rd             atomic.Value // read deadline for Accept()
+		wd             atomic.Value
+
+		// the first read error of the sockets, returned by AcceptKCP
+		chSocketReadError   chan struct{}
+		socketReadError     atomic.Value
+		socketReadErrorOnce sync.Once
+
+		cookieKey []byte            // the key of the handshake cookies
+		hsEncoder *handshakeEncoder // for the answers to the handshake
+		clock     Clock             // of the first connection, ages the cookies and runs the deadline
+
+		acceptFilter atomic.Value // AcceptFilter of the new sessions
+		admitLock    sync.Mutex   // serializes the filtering and creation of sessions
+	}
+)
+
+// SetReadBuffer sets the socket read buffer of all shards of the Listener
 func (l *Listener) SetReadBuffer(bytes int) error {
-	if nc, ok := l.conn.(setReadBuffer); ok {
-		return nc.SetReadBuffer(bytes)
+	for _, conn := range l.conns {
+		nc, ok := conn.(setReadBuffer)
+		if !ok {
+			return errInvalidOperation
+		}
+		if err := nc.SetReadBuffer(bytes); err != nil {
+			return err
+		}
 	}
-	return errInvalidOperation
+	return nil
 }
 
-// SetWriteBuffer sets the socket write buffer for the Listener
+// SetWriteBuffer sets the socket write buffer of all shards of the Listener
 func (l *Listener) SetWriteBuffer(bytes int) error {
-	if nc, ok := l.conn.(setWriteBuffer); ok {
-		return nc.SetWriteBuffer(bytes)
+	for _, conn := range l.conns {
+		nc, ok := conn.(setWriteBuffer)
+		if !ok {
+			return errInvalidOperation
+		}
+		if err := nc.SetWriteBuffer(bytes); err != nil {
+			return err
+		}
 	}
-	return errInvalidOperation
+	return nil
 }
 
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
@@ -705,12 +1669,22 @@ func (l *Listener) SetWriteBuffer(bytes int) error {
 // if the underlying connection has implemented `func SetDSCP(int) error`, SetDSCP() will invoke
 // this function instead.
 func (l *Listener) SetDSCP(dscp int) error {
+	for _, conn := range l.conns {
+		if err := setConnDSCP(conn, dscp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setConnDSCP sets the DSCP field of the packets sent by a single connection
+func setConnDSCP(conn net.PacketConn, dscp int) error {
 	// interface enabled
-	if ts, ok := l.conn.(setDSCP); ok {
+	if ts, ok := conn.(setDSCP); ok {
 		return ts.SetDSCP(dscp)
 	}
 
-	if nc, ok := l.conn.(net.Conn); ok {
+	if nc, ok := conn.(net.Conn); ok {
 		var succeed bool
 		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
 			succeed = true
@@ -731,11 +1705,14 @@ func (l *Listener) Accept() (net.Conn, error) {
 	return l.AcceptKCP()
 }
 
-// AcceptKCP accepts a KCP connection
+// AcceptKCP accepts a KCP connection, it returns the read error of the
+// underlying socket if one of the sockets has failed
 func (l *Listener) AcceptKCP() (*UDPSession, error) {
-	var timeout <-chan time.Time
+	var timeout <-chan struct{}
 	if tdeadline, ok := l.rd.Load().(time.Time); ok && !tdeadline.IsZero() {
-		timeout = time.After(tdeadline.Sub(time.Now()))
+		var stop func() bool
+		timeout, stop = after(l.clock, tdeadline.Sub(l.clock.Now()))
+		defer stop()
 	}
 
 	select {
@@ -743,11 +1720,27 @@ func (l *Listener) AcceptKCP() (*UDPSession, error) {
 		return nil, &errTimeout{}
 	case c := <-l.chAccepts:
 		return c, nil
+	case <-l.chSocketReadError:
+		return nil, l.socketReadError.Load().(error)
 	case <-l.die:
 		return nil, errBrokenPipe
 	}
 }
 
+// notifyReadError records the first read error of the sockets, the errors
+// after the listener has been closed are expected
+func (l *Listener) notifyReadError(err error) {
+	select {
+	case <-l.die:
+		return
+	default:
+	}
+	l.socketReadErrorOnce.Do(func() {
+		l.socketReadError.Store(err)
+		close(l.chSocketReadError)
+	})
+}
+
 // SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
 func (l *Listener) SetDeadline(t time.Time) error {
 	l.SetReadDeadline(t)
@@ -769,97 +1762,238 @@ func (l *Listener) SetWriteDeadline(t time.Time) error {
 
 // Close stops listening on the UDP address. Already Accepted connections are not closed.
 func (l *Listener) Close() error {
-	close(l.die)
-	return l.conn.Close()
+	l.dieOnce.Do(func() { close(l.die) })
+	return l.closeConns()
+}
+
+// closeConns closes the sockets of all shards
+func (l *Listener) closeConns() (err error) {
+	for _, conn := range l.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shutdown stops accepting sessions, and closes every session accepted,
+// including those still waiting in the accept backlog. The sessions keep
+// sending until the remotes have acknowledged all their data, as with
+// SetLinger, then the sockets are closed. If ctx is done before, the
+// remaining sessions are stopped at once and ctx's error is returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.dieOnce.Do(func() { close(l.die) })
+	sessions := l.Sessions()
+	for _, s := range sessions {
+		s.close(true)
+	}
+
+	var err error
+	for _, s := range sessions {
+		if err == nil {
+			select {
+			case <-s.dead:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			s.abort()
+		}
+	}
+
+	if e := l.closeConns(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Sessions returns the sessions accepted by the listener and not closed yet,
+// including those waiting in the accept backlog
+func (l *Listener) Sessions() []*UDPSession {
+	l.sessionLock.Lock()
+	defer l.sessionLock.Unlock()
+	sessions := make([]*UDPSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
 }
 
 // closeSession notify the listener that a session has closed
-func (l *Listener) closeSession(remote net.Addr) (ret bool) {
+func (l *Listener) closeSession(s *UDPSession) (ret bool) {
+	addrs := s.pathAddrs()
 	l.sessionLock.Lock()
 	defer l.sessionLock.Unlock()
-	if _, ok := l.sessions[remote.String()]; ok {
-		delete(l.sessions, remote.String())
+	for _, addr := range addrs {
+		if l.sessionsByAddr[addr] == s {
+			delete(l.sessionsByAddr, addr)
+		}
+	}
+	if l.sessions[s.kcp.conv] == s {
+		delete(l.sessions, s.kcp.conv)
 		return true
 	}
 	return false
 }
 
 // Addr returns the listener's network address, The Addr returned is shared by all invocations of Addr, so do not modify it.
-func (l *Listener) Addr() net.Addr { return l.conn.LocalAddr() }
+func (l *Listener) Addr() net.Addr { return l.conns[0].LocalAddr() }
 
 // Listen listens for incoming KCP packets addressed to the local address laddr on the network "udp"
-func Listen(laddr string) (net.Listener, error) { return ListenWithOptions(laddr, nil) }
+func Listen(laddr string) (net.Listener, error) { return ListenWithOptions(laddr, nil, 0, 0, 1) }
 
-// ListenWithOptions listens for incoming KCP packets addressed to the local address laddr on the network "udp" with packet encryption
-func ListenWithOptions(laddr string, block BlockCrypt) (*Listener, error) {
+// ListenWithOptions listens for incoming KCP packets addressed to the local address laddr on the network "udp" with packet encryption,
+// dataShards, parityShards defines Reed-Solomon Erasure Coding parametes.
+//
+// shards > 1 opens that many sockets on the same address with SO_REUSEPORT, each read by its own
+// goroutine, the kernel keeps the packets of a remote address on the same socket. Sessions of all
+// shards are presented by the same AcceptKCP. On platforms without SO_REUSEPORT load balancing a
+// single socket is used.
+//
+// An unspecified address is listened on "udp4" and "udp6" separately, as dual-stack sockets are not
+// available on every platform, it fails only if neither address family is available.
+func ListenWithOptions(laddr string, block BlockCrypt, dataShards, parityShards, shards int) (*Listener, error) {
 	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
 		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
 	}
-	conn, err := net.ListenUDP("udp", udpaddr)
-	if err != nil {
-		return nil, errors.Wrap(err, "net.ListenUDP")
+
+	networks := []string{"udp"}
+	if udpaddr.IP == nil || udpaddr.IP.IsUnspecified() {
+		networks = []string{"udp4", "udp6"}
+	}
+
+	var conns []net.PacketConn
+	for _, network := range networks {
+		c, e := listenShards(network, udpaddr, shards)
+		if e != nil {
+			err = e
+			continue
+		}
+		if len(conns) == 0 { // bind the other address family to the same port if it was chosen by the kernel
+			udpaddr = &net.UDPAddr{IP: udpaddr.IP, Port: c[0].LocalAddr().(*net.UDPAddr).Port}
+		}
+		conns = append(conns, c...)
+	}
+	if len(conns) == 0 {
+		return nil, err
+	}
+	return serveConns(block, dataShards, parityShards, conns), nil
+}
+
+// listenShards opens the sockets of the shards on 'network'
+func listenShards(network string, udpaddr *net.UDPAddr, shards int) ([]net.PacketConn, error) {
+	if shards <= 1 || !reusePortSupported {
+		conn, err := net.ListenUDP(network, udpaddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.ListenUDP")
+		}
+		return []net.PacketConn{conn}, nil
 	}
 
-	return ServeConn(block, conn)
+	conns := make([]net.PacketConn, 0, shards)
+	for i := 0; i < shards; i++ {
+		conn, err := listenReusePort(network, udpaddr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, errors.Wrap(err, "listenReusePort")
+		}
+		if i == 0 { // bind the other shards to the same port if it was chosen by the kernel
+			udpaddr = conn.LocalAddr().(*net.UDPAddr)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
 }
 
 // ServeConn serves KCP protocol for a single packet connection.
-func ServeConn(block BlockCrypt, conn net.PacketConn) (*Listener, error) {
+func ServeConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	return serveConns(block, dataShards, parityShards, []net.PacketConn{conn}), nil
+}
+
+// ServeConns serves KCP protocol for several packet connections, such as a
+// UDP socket and a tcpraw connection on the same port. The sessions migrate
+// between the connections, so a client spreading its packets over several
+// paths with a MultipathConn may mix UDP and TCP.
+func ServeConns(block BlockCrypt, dataShards, parityShards int, conns ...net.PacketConn) (*Listener, error) {
+	if len(conns) == 0 {
+		return nil, errors.New("no connection to serve")
+	}
+	return serveConns(block, dataShards, parityShards, conns), nil
+}
+
+// serveConns serves KCP protocol for the packet connections of all shards
+func serveConns(block BlockCrypt, dataShards, parityShards int, conns []net.PacketConn) *Listener {
+	useMTULimit()
 	l := new(Listener)
-	l.conn = conn
-	l.sessions = make(map[string]*UDPSession)
+	l.conns = conns
+	l.sessions = make(map[uint32]*UDPSession)
+	l.sessionsByAddr = make(map[string]*UDPSession)
 	l.chAccepts = make(chan *UDPSession, acceptBacklog)
-	l.chSessionClosed = make(chan net.Addr)
 	l.die = make(chan struct{})
+	l.chSocketReadError = make(chan struct{})
+	l.dataShards = dataShards
+	l.parityShards = parityShards
 	l.block = block
+	l.fecDecoder = newFECDecoder(rxFECMulti*(dataShards+parityShards), dataShards, parityShards)
 
 	// calculate header size
 	if l.block != nil {
 		l.headerSize += cryptHeaderSize
 	}
+	if l.fecDecoder != nil {
+		l.headerSize += fecHeaderSizePlus2
+	}
+	l.clock = connClock(conns[0])
+	l.cookieKey = newCookieKey()
+	l.hsEncoder = newHandshakeEncoder(l.block, l.fecDecoder != nil)
 
-	go l.monitor()
-	return l, nil
+	for _, conn := range l.conns {
+		go l.monitor(conn)
+	}
+	return l
 }
 
 // Dial connects to the remote address "raddr" on the network "udp"
-func Dial(raddr string) (net.Conn, error) { return DialWithOptions(raddr, nil) }
-
-// DialWithOptions connects to the remote address "raddr" on the network "udp" with packet encryption
-func DialWithOptions(raddr string, block BlockCrypt) (*UDPSession, error) {
-	// network type detection
-	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
-	if err != nil {
-		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
-	}
-	network := "udp4"
-	if udpaddr.IP.To4() == nil {
-		network = "udp"
-	}
-
-	conn, err := net.ListenUDP(network, nil)
-	if err != nil {
-		return nil, errors.Wrap(err, "net.DialUDP")
-	}
+func Dial(raddr string) (net.Conn, error) { return DialWithOptions(raddr, nil, 0, 0) }
 
-	return NewConn(raddr, block, conn)
+// DialWithOptions connects to the remote address "raddr" on the network "udp" with packet encryption,
+// dataShards, parityShards defines Reed-Solomon Erasure Coding parametes.
+//
+// A host name is resolved to all its addresses, which are tried in parallel in the way of happy
+// eyeballs, RFC 8305, each over a UDP socket of its address family.
+func DialWithOptions(raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	return DialDualStack(raddr, block, dataShards, parityShards, listenUDP)
 }
 
 // NewConn establishes a session and talks KCP protocol over a packet connection.
-func NewConn(raddr string, block BlockCrypt, conn net.PacketConn) (*UDPSession, error) {
+//
+// It returns once the server has accepted the session through the handshake,
+// or ErrHandshakeTimeout if the server hasn't answered in 10 seconds. A conv
+// the server rejects as in use is replaced by a new one. The connection is
+// read directly during the handshake, and left open on error.
+func NewConn(raddr string, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
 	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
 	if err != nil {
 		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
 	}
 
 	var convid uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &convid)
-	return newUDPSession(convid, nil, conn, udpaddr, block), nil
+	fec := dataShards > 0 && parityShards > 0
+	for try := 1; ; try++ {
+		binary.Read(rand.Reader, binary.LittleEndian, &convid)
+		err := dialHandshake(conn, udpaddr, convid, block, fec)
+		if err == nil {
+			break
+		} else if err != ErrConvInUse || try == handshakeConvTries {
+			return nil, err
+		}
+	}
+	if mc, ok := conn.(*MultipathConn); ok {
+		mc.startProbes(convid)
+	}
+	return newUDPSession(convid, dataShards, parityShards, nil, nil, conn, udpaddr, block), nil
 }
-
-// monotonic reference time point
-var refTime = time.Now()
-
-// currentMs returns current elasped monotonic milliseconds since program startup
-func currentMs() uint32 { return uint32(time.Now().Sub(refTime) / time.Millisecond) }
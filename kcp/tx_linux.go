@@ -0,0 +1,44 @@
+// +build linux
+
+package kcp
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+)
+
+// tx writes the packets in batch with sendmmsg if the connection supports it
+func (s *UDPSession) tx(txqueue []ipv4.Message) {
+	// default version
+	if s.xconn == nil || s.xconnWriteError != nil {
+		s.defaultTx(txqueue)
+		return
+	}
+
+	// x/net version
+	nbytes := 0
+	npkts := 0
+	for len(txqueue) > 0 {
+		if n, err := s.xconn.WriteBatch(txqueue, 0); err == nil {
+			for k := range txqueue[:n] {
+				nbytes += len(txqueue[k].Buffers[0])
+			}
+			npkts += n
+			txqueue = txqueue[n:]
+		} else {
+			// compatibility issue:
+			// for linux kernel<=2.6.32, support for sendmmsg is not available
+			if isSyscallError(err, "sendmmsg") {
+				s.xconnWriteError = err
+				s.defaultTx(txqueue)
+				break
+			}
+			s.notifyWriteError(err)
+			break
+		}
+	}
+
+	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
+	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+}
@@ -1,104 +1,270 @@
 package kcp
 
 import (
-	"container/heap"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var updater updateHeap
+const (
+	// the resolution of the update schedule
+	wheelTick = time.Millisecond
+
+	// slots of a timer wheel, a power of 2, a revolution covers this many ticks
+	wheelSlots = 1024
+
+	// the slot of a session being updated, or not in a wheel
+	wheelRunning = -2
+	wheelNone    = -1
+)
+
+// the updater of the sessions on the system clock
+var defaultUpdater *updater
 
 func init() {
-	updater.init()
-	go updater.updateTask()
+	defaultUpdater = newUpdater(SystemClock, runtime.GOMAXPROCS(0))
+	defaultUpdater.start()
 }
 
-// entry contains a session update info
-type entry struct {
-	ts time.Time
-	s  *UDPSession
+// updater calls update() of its sessions periodically, the sessions are
+// spread over the shards, each of them a timer wheel run by a goroutine
+type updater struct {
+	shards []*timerWheel
+	next   uint32 // the shard of the next session, round-robin
 }
 
-// a global heap managed kcp.flush() caller
-type updateHeap struct {
-	entries  []entry
-	mu       sync.Mutex
-	chWakeUp chan struct{}
+func newUpdater(clock Clock, shards int) *updater {
+	u := new(updater)
+	u.shards = make([]*timerWheel, shards)
+	for k := range u.shards {
+		u.shards[k] = newTimerWheel(clock)
+	}
+	return u
 }
 
-func (h *updateHeap) Len() int           { return len(h.entries) }
-func (h *updateHeap) Less(i, j int) bool { return h.entries[i].ts.Before(h.entries[j].ts) }
-func (h *updateHeap) Swap(i, j int) {
-	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
-	h.entries[i].s.updaterIdx = i
-	h.entries[j].s.updaterIdx = j
+// start runs the shards on real timers
+func (u *updater) start() {
+	for _, w := range u.shards {
+		go w.run()
+	}
 }
 
-func (h *updateHeap) Push(x interface{}) {
-	h.entries = append(h.entries, x.(entry))
-	n := len(h.entries)
-	h.entries[n-1].s.updaterIdx = n - 1
+// addSession assigns a session to a shard, to be updated from now on
+func (u *updater) addSession(s *UDPSession) {
+	w := u.shards[int(atomic.AddUint32(&u.next, 1)-1)%len(u.shards)]
+	s.wheel = w
+	w.mu.Lock()
+	w.add(s, w.clock.Now())
+	w.mu.Unlock()
+	w.wakeup()
 }
 
-func (h *updateHeap) Pop() interface{} {
-	n := len(h.entries)
-	x := h.entries[n-1]
-	h.entries[n-1].s.updaterIdx = -1
-	h.entries[n-1] = entry{} // manual set nil for GC
-	h.entries = h.entries[0 : n-1]
-	return x
+// removeSession stops updating a session
+func (u *updater) removeSession(s *UDPSession) {
+	if w := s.wheel; w != nil {
+		w.mu.Lock()
+		w.remove(s)
+		w.mu.Unlock()
+	}
 }
 
-func (h *updateHeap) init() {
-	h.chWakeUp = make(chan struct{}, 1)
+// wakeSession updates a session at once, or right after the update in progress
+func (u *updater) wakeSession(s *UDPSession) {
+	if w := s.wheel; w != nil {
+		w.mu.Lock()
+		if s.timer.slot >= 0 {
+			w.remove(s)
+			w.add(s, w.clock.Now())
+		} else if s.timer.slot == wheelRunning {
+			s.timer.rerun = true
+		}
+		w.mu.Unlock()
+		w.wakeup()
+	}
 }
 
-func (h *updateHeap) addSession(s *UDPSession) {
-	h.mu.Lock()
-	heap.Push(h, entry{time.Now(), s})
-	h.mu.Unlock()
-	h.wakeup()
+// wheelEntry is the position of a session in a timer wheel
+type wheelEntry struct {
+	due   int64 // the tick the session is due
+	slot  int   // the slot holding the session, or wheelRunning, wheelNone
+	idx   int   // index in the slot
+	rerun bool  // woken up while running, to be updated again at once
 }
 
-func (h *updateHeap) removeSession(s *UDPSession) {
-	h.mu.Lock()
-	if s.updaterIdx != -1 {
-		heap.Remove(h, s.updaterIdx)
+// timerWheel is a hashed timer wheel of sessions, the sessions due in the
+// ticks congruent modulo wheelSlots share a slot
+type timerWheel struct {
+	mu       sync.Mutex
+	clock    Clock
+	base     time.Time // the time of tick 0
+	tick     int64     // the ticks before are processed
+	slots    [wheelSlots][]*UDPSession
+	count    int          // sessions in the slots
+	due      []dueSession // sessions being updated by runDue
+	chWakeUp chan struct{}
+}
+
+// a session taken out of a wheel to be updated
+type dueSession struct {
+	s  *UDPSession
+	at time.Time // the time it was due
+}
+
+func newTimerWheel(clock Clock) *timerWheel {
+	w := new(timerWheel)
+	w.clock = clock
+	w.base = clock.Now()
+	w.chWakeUp = make(chan struct{}, 1)
+	return w
+}
+
+// tickOf returns the tick in progress at 't'
+func (w *timerWheel) tickOf(t time.Time) int64 { return int64(t.Sub(w.base) / wheelTick) }
+
+// timeOf returns the time a tick starts
+func (w *timerWheel) timeOf(tick int64) time.Time { return w.base.Add(time.Duration(tick) * wheelTick) }
+
+// add schedules a session at 't', rounded up to a tick
+func (w *timerWheel) add(s *UDPSession, t time.Time) {
+	due := int64((t.Sub(w.base) + wheelTick - 1) / wheelTick)
+	if due < w.tick {
+		due = w.tick
 	}
-	h.mu.Unlock()
+	slot := int(due & (wheelSlots - 1))
+	s.timer = wheelEntry{due, slot, len(w.slots[slot]), false}
+	w.slots[slot] = append(w.slots[slot], s)
+	w.count++
 }
 
-func (h *updateHeap) wakeup() {
+// remove unschedules a session, a session being updated is not scheduled again
+func (w *timerWheel) remove(s *UDPSession) {
+	t := &s.timer
+	if t.slot >= 0 {
+		q := w.slots[t.slot]
+		last := len(q) - 1
+		q[t.idx] = q[last]
+		q[t.idx].timer.idx = t.idx
+		q[last] = nil
+		w.slots[t.slot] = q[:last]
+		w.count--
+	}
+	t.slot = wheelNone
+}
+
+func (w *timerWheel) wakeup() {
 	select {
-	case h.chWakeUp <- struct{}{}:
+	case w.chWakeUp <- struct{}{}:
 	default:
 	}
 }
 
-func (h *updateHeap) updateTask() {
-	var timer <-chan time.Time
+// run updates the sessions in time on real timers
+func (w *timerWheel) run() {
+	timer := time.NewTimer(time.Hour)
 	for {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var wait <-chan time.Time
+		if next := w.runDue(); !next.IsZero() {
+			timer.Reset(next.Sub(w.clock.Now()))
+			wait = timer.C
+		}
+
 		select {
-		case <-timer:
-		case <-h.chWakeUp:
+		case <-wait:
+		case <-w.chWakeUp:
 		}
+	}
+}
 
-		h.mu.Lock()
-		hlen := h.Len()
-		for i := 0; i < hlen; i++ {
-			entry := &h.entries[0]
-			if time.Now().After(entry.ts) {
-				interval := entry.s.update()
-				entry.ts = time.Now().Add(interval)
-				heap.Fix(h, 0)
+// runDue updates the sessions due by now, and returns the time the wheel is
+// to be visited again, zero if it's empty. The sessions are updated without
+// holding the wheel, so that sessions can be added or removed meanwhile.
+func (w *timerWheel) runDue() time.Time {
+	w.mu.Lock()
+	now := w.tickOf(w.clock.Now())
+	from := w.tick
+	if now-from >= wheelSlots { // a revolution visits every slot
+		from = now - wheelSlots + 1
+	}
+	due := w.due[:0]
+	for tick := from; tick <= now; tick++ {
+		slot := int(tick & (wheelSlots - 1))
+		for i := 0; i < len(w.slots[slot]); {
+			s := w.slots[slot][i]
+			if s.timer.due <= now {
+				w.remove(s)
+				s.timer.slot = wheelRunning
+				due = append(due, dueSession{s, w.timeOf(s.timer.due)})
 			} else {
-				break
+				i++
+			}
+		}
+	}
+	if now >= w.tick {
+		w.tick = now + 1
+	}
+	w.mu.Unlock()
+
+	start := time.Now()
+	for k := range due {
+		s := due[k].s
+		lag := w.clock.Now().Sub(due[k].at)
+		interval := s.update()
+		w.mu.Lock()
+		if s.timer.slot == wheelRunning {
+			if s.timer.rerun {
+				interval = 0
+			}
+			w.add(s, w.clock.Now().Add(interval))
+		}
+		w.mu.Unlock()
+		due[k] = dueSession{}
+		snmpUpdateLag(lag)
+	}
+	if len(due) > 0 {
+		atomic.AddUint64(&DefaultSnmp.UpdateCalls, uint64(len(due)))
+		atomic.AddUint64(&DefaultSnmp.UpdateTime, uint64(time.Since(start)/time.Microsecond))
+	}
+	w.due = due
+
+	// the earliest session due in a revolution is in the first slot holding
+	// one, otherwise every slot is visited to find the earliest one
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	next := int64(-1)
+	for tick := w.tick; tick < w.tick+wheelSlots && w.count > 0; tick++ {
+		for _, s := range w.slots[tick&(wheelSlots-1)] {
+			if s.timer.due == tick {
+				return w.timeOf(tick)
+			}
+			if next < 0 || s.timer.due < next {
+				next = s.timer.due
 			}
 		}
+	}
+	if next >= 0 {
+		return w.timeOf(next)
+	}
+	return time.Time{}
+}
 
-		if hlen > 0 {
-			timer = time.After(h.entries[0].ts.Sub(time.Now()))
+// snmpUpdateLag accounts how late an update() has run
+func snmpUpdateLag(lag time.Duration) {
+	if lag <= 0 {
+		return
+	}
+	us := uint64(lag / time.Microsecond)
+	atomic.AddUint64(&DefaultSnmp.UpdateLag, us)
+	for {
+		max := atomic.LoadUint64(&DefaultSnmp.UpdateLagMax)
+		if us <= max || atomic.CompareAndSwapUint64(&DefaultSnmp.UpdateLagMax, max, us) {
+			return
 		}
-		h.mu.Unlock()
 	}
 }
@@ -0,0 +1,79 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// an idle session is only visited by the timer wheel at the idle interval,
+// and is woken up at once by a write or an incoming packet
+func TestIdleWake(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	tests := []struct {
+		name   string
+		writes int32 // the packets written after waking up, at least
+		wake   func(s *UDPSession)
+	}{
+		// the segment and its retransmission, as it's never acknowledged
+		{"write", 2, func(s *UDPSession) { s.Write([]byte("hello")) }},
+		// the ack of the segment
+		{"input", 1, func(s *UDPSession) {
+			var pkt []byte
+			peer := NewKCP(s.GetConv(), func(buf []byte, size int) { pkt = append(pkt[:0], buf[:size]...) })
+			peer.Send([]byte("hello"))
+			peer.flush(false)
+			s.packetInput(pkt, remote)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			clock := NewManualClock(time.Unix(1e9, 0))
+			conn := &silentConn{PacketConn: raw, clock: clock}
+			s := newUDPSession(1, 0, 0, nil, nil, conn, remote, nil)
+			defer s.Close()
+			s.SetNoDelay(1, 10, 2, 1)
+
+			// the time the session is due, and whether it's idle
+			due := func() (time.Duration, bool) {
+				s.mu.Lock()
+				idle := s.idle
+				s.mu.Unlock()
+				w := s.wheel
+				w.mu.Lock()
+				defer w.mu.Unlock()
+				return w.timeOf(s.timer.due).Sub(clock.Now()), idle
+			}
+
+			clock.Advance(100 * time.Millisecond)
+			d, idle := due()
+			if !idle || d < idleInterval-time.Second {
+				t.Fatalf("idle %v, due in %v", idle, d)
+			}
+			clock.Advance(idleInterval / 2)
+			if d2, _ := due(); d2 != d-idleInterval/2 {
+				t.Fatalf("updated while idle, due in %v", d2)
+			}
+			if n := atomic.LoadInt32(&conn.writes); n != 0 {
+				t.Fatal(n, "packets written while idle")
+			}
+
+			tt.wake(s)
+			d, idle = due()
+			if idle || d > 0 {
+				t.Fatalf("not woken up, idle %v, due in %v", idle, d)
+			}
+			clock.Advance(time.Second)
+			if n := atomic.LoadInt32(&conn.writes); n < tt.writes {
+				t.Fatal(n, "packets written after waking up")
+			}
+		})
+	}
+}
@@ -15,17 +15,31 @@ type Config struct {
 	Crypt        string            `json:"crypt"`
 	Mode         string            `json:"mode"`
 	MTU          int               `json:"mtu"`
+	MTULimit     int               `json:"mtulimit"`
+	PMTUD        bool              `json:"pmtud"`
 	SndWnd       int               `json:"sndwnd"`
 	RcvWnd       int               `json:"rcvwnd"`
+	DataShard    int               `json:"datashard"`
+	ParityShard  int               `json:"parityshard"`
+	FECAdaptive  bool              `json:"fecadaptive"`
 	DSCP         int               `json:"dscp"`
 	AckNodelay   bool              `json:"acknodelay"`
 	NoDelay      int               `json:"nodelay"`
 	Interval     int               `json:"interval"`
 	Resend       int               `json:"resend"`
 	NoCongestion int               `json:"nc"`
+	Congestion   string            `json:"congestion"`
+	DeadLink     int               `json:"deadlink"`
+	RateLimit    int               `json:"ratelimit"`
+	Pacing       bool              `json:"pacing"`
+	Shards       int               `json:"shards"`
 	SockBuf      int               `json:"sockbuf"`
 	KeepAlive    int               `json:"keepalive"`
+	IdleTimeout  int               `json:"idletimeout"`
 	Log          string            `json:"log"`
+	SnmpLog      string            `json:"snmplog"`
+	SnmpPeriod   int               `json:"snmpperiod"`
+	StatsPeriod  int               `json:"statsperiod"`
 	Quiet        bool              `json:"quiet"`
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"io"
 	"log"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/JimLee1996/tun/kcp"
 	"github.com/JimLee1996/tun/smux"
+	"github.com/JimLee1996/tun/std"
 	"github.com/JimLee1996/tun/tcpraw"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/pbkdf2"
@@ -24,6 +26,14 @@ var (
 	SALT = "swag"
 )
 
+const (
+	// the sessions of a failed listener are given this long to drain
+	shutdownTimeout = 5 * time.Second
+
+	// a failed listener is listened again after this delay
+	relistenDelay = time.Second
+)
+
 // handle multiplex-ed connection
 func handleMux(conn io.ReadWriteCloser, config *Config) {
 	// stream multiplex
@@ -37,6 +47,9 @@ func handleMux(conn io.ReadWriteCloser, config *Config) {
 		return
 	}
 	defer mux.Close()
+	if kcpconn, ok := conn.(*kcp.UDPSession); ok {
+		go std.StatsLogger(kcpconn, mux, config.StatsPeriod)
+	}
 	for {
 		stream, err := mux.AcceptStream()
 		if err != nil {
@@ -133,6 +146,15 @@ func main() {
 			Value: 1350,
 			Usage: "set maximum transmission unit for UDP packets",
 		},
+		cli.IntFlag{
+			Name:  "mtulimit",
+			Value: 1500,
+			Usage: "the largest UDP packet ever sent or received, above 1500 for jumbo frames",
+		},
+		cli.BoolFlag{
+			Name:  "pmtud",
+			Usage: "discover the path mtu with DF-marked probes, up to mtulimit",
+		},
 		cli.IntFlag{
 			Name:  "sndwnd",
 			Value: 1024,
@@ -143,6 +165,20 @@ func main() {
 			Value: 1024,
 			Usage: "set receive window size(num of packets)",
 		},
+		cli.IntFlag{
+			Name:  "datashard,ds",
+			Value: 0,
+			Usage: "set reed-solomon erasure coding - datashard, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "parityshard,ps",
+			Value: 0,
+			Usage: "set reed-solomon erasure coding - parityshard, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "fecadaptive",
+			Usage: "adapt the parityshards sent to the measured loss rate, parityshard as the upper bound",
+		},
 		cli.IntFlag{
 			Name:  "dscp",
 			Value: 0,
@@ -173,6 +209,30 @@ func main() {
 			Value:  0,
 			Hidden: true,
 		},
+		cli.StringFlag{
+			Name:  "congestion",
+			Value: "",
+			Usage: "congestion control: reno, bbr, it overrides nc of the mode profiles",
+		},
+		cli.IntFlag{
+			Name:  "deadlink",
+			Value: 20,
+			Usage: "close the connection after a segment has been sent this many times, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "ratelimit",
+			Value: 0,
+			Usage: "per-connection send rate limit in bytes per second, 0 for unlimited",
+		},
+		cli.BoolFlag{
+			Name:  "pacing",
+			Usage: "spread packets over the flush interval instead of sending them in bursts",
+		},
+		cli.IntFlag{
+			Name:  "shards",
+			Value: 1,
+			Usage: "number of SO_REUSEPORT sockets per udp port, to spread the load over cores",
+		},
 		cli.IntFlag{
 			Name:  "sockbuf",
 			Value: 4194304, // socket buffer size in bytes
@@ -181,7 +241,27 @@ func main() {
 		cli.IntFlag{
 			Name:  "keepalive",
 			Value: 10, // nat keepalive interval in seconds
-			Usage: "seconds between heartbeats",
+			Usage: "seconds between heartbeats, of both smux and kcp",
+		},
+		cli.IntFlag{
+			Name:  "idletimeout",
+			Value: 0,
+			Usage: "close a connection after receiving nothing for this many seconds, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "snmplog",
+			Value: "",
+			Usage: "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+		},
+		cli.IntFlag{
+			Name:  "snmpperiod",
+			Value: 60,
+			Usage: "snmp collect period, in seconds",
+		},
+		cli.IntFlag{
+			Name:  "statsperiod",
+			Value: 0,
+			Usage: "seconds between logging the transport stats of each session, 0 to disable",
 		},
 		cli.StringFlag{
 			Name:  "log",
@@ -207,16 +287,30 @@ func main() {
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.MTU = c.Int("mtu")
+		config.MTULimit = c.Int("mtulimit")
+		config.PMTUD = c.Bool("pmtud")
 		config.SndWnd = c.Int("sndwnd")
 		config.RcvWnd = c.Int("rcvwnd")
+		config.DataShard = c.Int("datashard")
+		config.ParityShard = c.Int("parityshard")
+		config.FECAdaptive = c.Bool("fecadaptive")
 		config.DSCP = c.Int("dscp")
 		config.AckNodelay = c.Bool("acknodelay")
 		config.NoDelay = c.Int("nodelay")
 		config.Interval = c.Int("interval")
 		config.Resend = c.Int("resend")
 		config.NoCongestion = c.Int("nc")
+		config.Congestion = c.String("congestion")
+		config.DeadLink = c.Int("deadlink")
+		config.RateLimit = c.Int("ratelimit")
+		config.Pacing = c.Bool("pacing")
+		config.Shards = c.Int("shards")
 		config.SockBuf = c.Int("sockbuf")
 		config.KeepAlive = c.Int("keepalive")
+		config.IdleTimeout = c.Int("idletimeout")
+		config.SnmpLog = c.String("snmplog")
+		config.SnmpPeriod = c.Int("snmpperiod")
+		config.StatsPeriod = c.Int("statsperiod")
 		config.Log = c.String("log")
 		config.Quiet = c.Bool("quiet")
 
@@ -244,8 +338,13 @@ func main() {
 		case "fast3":
 			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
 		}
+		if config.Congestion != "" {
+			config.NoCongestion = 0
+		}
 
 		log.Println("version:", VERSION)
+		checkError(kcp.SetMTULimit(config.MTULimit))
+
 		log.Println("initiating key derivation")
 		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
 		log.Println("key derivation done")
@@ -260,19 +359,30 @@ func main() {
 		log.Println("target:", config.Target)
 		log.Println("encryption:", config.Crypt)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+		log.Println("congestion:", config.Congestion)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("mtu:", config.MTU)
+		log.Println("mtu:", config.MTU, "mtulimit:", config.MTULimit)
+		log.Println("pmtud:", config.PMTUD)
+		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+		log.Println("fecadaptive:", config.FECAdaptive)
 		log.Println("acknodelay:", config.AckNodelay)
 		log.Println("dscp:", config.DSCP)
+		log.Println("deadlink:", config.DeadLink)
+		log.Println("ratelimit:", config.RateLimit)
+		log.Println("pacing:", config.Pacing)
+		log.Println("shards:", config.Shards)
 		log.Println("sockbuf:", config.SockBuf)
 		log.Println("keepalive:", config.KeepAlive)
+		log.Println("idletimeout:", config.IdleTimeout)
+		log.Println("snmplog:", config.SnmpLog)
+		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("statsperiod:", config.StatsPeriod)
 		log.Println("quiet:", config.Quiet)
 
-		// main loop
-		var wg sync.WaitGroup
-		loop := func(lis *kcp.Listener) {
-			defer wg.Done()
+		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
 
+		// serve accepts the sessions of a listener until it fails
+		serve := func(lis *kcp.Listener) error {
 			if err := lis.SetDSCP(config.DSCP); err != nil {
 				log.Println("SetDSCP:", err)
 			}
@@ -290,11 +400,49 @@ func main() {
 					conn.SetWriteDelay(false)
 					conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 					conn.SetMtu(config.MTU)
+					if config.PMTUD {
+						if err := conn.SetPMTUDiscovery(true); err != nil {
+							log.Println("SetPMTUDiscovery:", err)
+						}
+					}
 					conn.SetWindowSize(config.SndWnd, config.RcvWnd)
 					conn.SetACKNoDelay(config.AckNodelay)
+					conn.SetFECAdaptive(config.FECAdaptive)
+					conn.SetDeadLink(config.DeadLink)
+					conn.SetPacing(config.Pacing)
+					conn.SetRateLimit(config.RateLimit)
+					conn.SetKeepAlive(time.Duration(config.KeepAlive) * time.Second)
+					conn.SetIdleTimeout(time.Duration(config.IdleTimeout) * time.Second)
+					switch config.Congestion {
+					case "reno":
+						conn.SetCongestionController(kcp.NewRenoController())
+					case "bbr":
+						conn.SetCongestionController(kcp.NewBBRController())
+					}
 					go handleMux(conn, &config)
 				} else {
-					log.Printf("%+v", err)
+					return err
+				}
+			}
+		}
+
+		// main loop, a failed listener is shut down and listened again
+		var wg sync.WaitGroup
+		loop := func(lis *kcp.Listener, listen func() (*kcp.Listener, error)) {
+			defer wg.Done()
+			for {
+				err := serve(lis)
+				log.Printf("listener %v failed: %+v", lis.Addr(), err)
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				lis.Shutdown(ctx)
+				cancel()
+
+				for {
+					time.Sleep(relistenDelay)
+					if lis, err = listen(); err == nil {
+						break
+					}
+					log.Println(err)
 				}
 			}
 		}
@@ -306,23 +454,36 @@ func main() {
 
 		// listen multiple ports
 		for addr, protocol := range config.Listens {
+			addr := addr
 			if protocol == "tcp" || protocol == "all" {
 				log.Println("listening (tcp) on:", addr)
-				if conn, err := tcpraw.Listen("tcp", addr); err == nil {
-					lis, err := kcp.ServeConn(block, conn)
-					checkError(err)
+				listen := func() (*kcp.Listener, error) {
+					conn, err := tcpraw.Listen("tcp", addr)
+					if err != nil {
+						return nil, err
+					}
+					lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+					if err != nil {
+						conn.Close()
+					}
+					return lis, err
+				}
+				if lis, err := listen(); err == nil {
 					wg.Add(1)
-					go loop(lis)
+					go loop(lis, listen)
 				} else {
 					log.Println(err)
 				}
 			}
 			if protocol == "udp" || protocol == "all" {
 				log.Println("listening (udp) on:", addr)
-				lis, err := kcp.ListenWithOptions(addr, block)
+				listen := func() (*kcp.Listener, error) {
+					return kcp.ListenWithOptions(addr, block, config.DataShard, config.ParityShard, config.Shards)
+				}
+				lis, err := listen()
 				checkError(err)
 				wg.Add(1)
-				go loop(lis)
+				go loop(lis, listen)
 			}
 		}
 
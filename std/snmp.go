@@ -0,0 +1,63 @@
+// Package std holds the code shared by the client and the server
+package std
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JimLee1996/tun/kcp"
+	"github.com/JimLee1996/tun/smux"
+)
+
+// SnmpLogger appends kcp.DefaultSnmp to a csv file every 'interval' seconds,
+// the filename of 'path' is formatted as a golang time layout, like: ./snmp-20060102.log
+func SnmpLogger(path string, interval int) {
+	if path == "" || interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		// split path into dirname and filename
+		logdir, logfile := filepath.Split(path)
+		// only format logfile
+		f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		w := csv.NewWriter(f)
+		// write header in empty file
+		if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
+			if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
+				log.Println(err)
+			}
+		}
+		if err := w.Write(append([]string{fmt.Sprint(time.Now().Unix())}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
+			log.Println(err)
+		}
+		kcp.DefaultSnmp.Reset()
+		w.Flush()
+		f.Close()
+	}
+}
+
+// StatsLogger logs the transport stats of a session every 'interval' seconds,
+// until the multiplexer on top of it has closed
+func StatsLogger(conn *kcp.UDPSession, mux *smux.Session, interval int) {
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if mux.IsClosed() {
+			return
+		}
+		log.Printf("stats: %v -> %v %+v", conn.LocalAddr(), conn.RemoteAddr(), conn.Stats())
+	}
+}
@@ -315,6 +315,15 @@ func (conn *TCPConn) Close() error {
 	return err
 }
 
+// RemoteAddr returns the remote network address of a connection from Dial,
+// nil for a connection from Listen.
+func (conn *TCPConn) RemoteAddr() net.Addr {
+	if conn.tcpconn != nil {
+		return conn.tcpconn.RemoteAddr()
+	}
+	return nil
+}
+
 // LocalAddr returns the local network address.
 func (conn *TCPConn) LocalAddr() net.Addr {
 	if conn.tcpconn != nil {
@@ -381,24 +390,26 @@ func (conn *TCPConn) SetWriteBuffer(bytes int) error {
 }
 
 // Dial connects to the remote TCP port,
-// and returns a single packet-oriented connection
+// and returns a single packet-oriented connection.
+//
+// The addresses of a host name are tried as by net.Dial, both address
+// families in parallel, the connection keeps the first one established.
 func Dial(network, address string) (*TCPConn, error) {
-	// remote address resolve
-	raddr, err := net.ResolveTCPAddr(network, address)
-	if err != nil {
-		return nil, err
-	}
-
-	// AF_INET
-	handle, err := net.DialIP("ip:tcp", nil, &net.IPAddr{IP: raddr.IP})
+	// create an established tcp connection
+	// will hack this tcp connection for packet transmission
+	c, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
+	tcpconn := c.(*net.TCPConn)
+	raddr := tcpconn.RemoteAddr().(*net.TCPAddr)
+	laddr := tcpconn.LocalAddr().(*net.TCPAddr)
 
-	// create an established tcp connection
-	// will hack this tcp connection for packet transmission
-	tcpconn, err := net.DialTCP(network, nil, raddr)
+	// AF_INET or AF_INET6 as the established path, bound to its local address
+	// which the TCP checksum is computed from
+	handle, err := net.DialIP(ipNetwork(raddr.IP), &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}, &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone})
 	if err != nil {
+		tcpconn.Close()
 		return nil, err
 	}
 
@@ -420,6 +431,7 @@ func Dial(network, address string) (*TCPConn, error) {
 	// iptables
 	err = setTTL(tcpconn, 1)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -483,7 +495,12 @@ func Listen(network, address string) (*TCPConn, error) {
 			if addrs, err := iface.Addrs(); err == nil {
 				for _, addr := range addrs {
 					if ipaddr, ok := addr.(*net.IPNet); ok {
-						if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: ipaddr.IP}); err == nil {
+						// both address families, the link-local addresses are scoped to the interface
+						ip := &net.IPAddr{IP: ipaddr.IP}
+						if ipaddr.IP.IsLinkLocalUnicast() && ipaddr.IP.To4() == nil {
+							ip.Zone = iface.Name
+						}
+						if handle, err := net.ListenIP(ipNetwork(ipaddr.IP), ip); err == nil {
 							conn.handles = append(conn.handles, handle)
 							go conn.captureFlow(handle, laddr.Port)
 						} else {
@@ -497,7 +514,7 @@ func Listen(network, address string) (*TCPConn, error) {
 			return nil, lasterr
 		}
 	} else {
-		if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: laddr.IP}); err == nil {
+		if handle, err := net.ListenIP(ipNetwork(laddr.IP), &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}); err == nil {
 			conn.handles = append(conn.handles, handle)
 			go conn.captureFlow(handle, laddr.Port)
 		} else {
@@ -566,6 +583,14 @@ func Listen(network, address string) (*TCPConn, error) {
 	return conn, nil
 }
 
+// ipNetwork returns the raw TCP network of the address family of 'ip'
+func ipNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4:tcp"
+	}
+	return "ip6:tcp"
+}
+
 // setTTL sets the Time-To-Live field on a given connection
 func setTTL(c *net.TCPConn, ttl int) error {
 	raw, err := c.SyscallConn()